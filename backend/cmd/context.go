@@ -13,6 +13,9 @@ type contextKey string
 // store the value of the token
 const userContextKey = contextKey("user")
 
+// set when the request was authenticated with an API key
+const apiKeyContextKey = contextKey("api_key")
+
 // setUserContext
 func (app *application) contextSetUser(r *http.Request, user *models.User) *http.Request {
 	ctx := context.WithValue(r.Context(), userContextKey, user)
@@ -30,3 +33,14 @@ func (app *application) contextGetUser(r *http.Request) *models.User {
 
 	return user
 }
+
+func (app *application) contextSetAPIKey(r *http.Request, key *models.APIKey) *http.Request {
+	ctx := context.WithValue(r.Context(), apiKeyContextKey, key)
+	return r.WithContext(ctx)
+}
+
+// Returns nil when the request did not come in with an API key
+func (app *application) contextGetAPIKey(r *http.Request) *models.APIKey {
+	key, _ := r.Context().Value(apiKeyContextKey).(*models.APIKey)
+	return key
+}
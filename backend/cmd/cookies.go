@@ -0,0 +1,109 @@
+package main
+
+import (
+	"backend/models"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"time"
+)
+
+// In cookie mode the tokens never reach JavaScript. The CSRF cookie is the
+// one exception, the frontend copies it into a header on every write
+const (
+	sessionCookie = "session"
+	refreshCookie = "refresh_token"
+	csrfCookie    = "csrf_token"
+	csrfHeader    = "X-CSRF-Token"
+)
+
+// Browsers opt in to cookie mode per request by sending this header with the
+// value "cookie" when they sign in. Other clients keep getting tokens in the body
+const sessionModeHeader = "X-Session-Mode"
+
+// The refresh cookie is only ever sent to the endpoint that needs it
+const refreshCookiePath = "/v1/tokens/refresh"
+
+func (app *application) newCookie(name, value, path string, expiry time.Time, httpOnly bool) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		Domain:   app.config.Cookie.Domain,
+		Expires:  expiry,
+		HttpOnly: httpOnly,
+		Secure:   app.config.Env != "development",
+		SameSite: http.SameSiteStrictMode,
+	}
+}
+
+// Puts a fresh session into cookies and returns the matching CSRF token
+func (app *application) setSessionCookies(w http.ResponseWriter, token, refreshToken *models.Token) (string, error) {
+	randomBytes := make([]byte, 32)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+
+	csrfToken := base64.RawURLEncoding.EncodeToString(randomBytes)
+
+	http.SetCookie(w, app.newCookie(sessionCookie, token.Plaintext, "/", token.Expiry, true))
+	http.SetCookie(w, app.newCookie(refreshCookie, refreshToken.Plaintext, refreshCookiePath, refreshToken.Expiry, true))
+	http.SetCookie(w, app.newCookie(csrfCookie, csrfToken, "/", refreshToken.Expiry, false))
+
+	return csrfToken, nil
+}
+
+func (app *application) clearSessionCookies(w http.ResponseWriter) {
+	for _, cookie := range []*http.Cookie{
+		app.newCookie(sessionCookie, "", "/", time.Unix(0, 0), true),
+		app.newCookie(refreshCookie, "", refreshCookiePath, time.Unix(0, 0), true),
+		app.newCookie(csrfCookie, "", "/", time.Unix(0, 0), false),
+	} {
+		cookie.MaxAge = -1
+		http.SetCookie(w, cookie)
+	}
+}
+
+// Reads a cookie value, empty when the request does not carry it
+func (app *application) readCookie(r *http.Request, name string) string {
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return ""
+	}
+
+	return cookie.Value
+}
+
+// A session is handed out as cookies when the client asks for it, or when it
+// is being refreshed with the refresh cookie of an earlier cookie session
+func (app *application) wantsSessionCookies(r *http.Request) bool {
+	return r.Header.Get(sessionModeHeader) == "cookie" || app.readCookie(r, refreshCookie) != ""
+}
+
+// Finds the session token of this request in the Authorization header or
+// the session cookie
+func (app *application) readSessionToken(r *http.Request) (string, bool) {
+	if r.Header.Get("Authorization") != "" {
+		return app.readBearerToken(r)
+	}
+
+	token := app.readCookie(r, sessionCookie)
+	return token, token != ""
+}
+
+// Double submit check: writes made with cookies must echo the CSRF cookie in
+// a header, which a page on another site has no way of reading
+func (app *application) validCSRF(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+
+	cookie := app.readCookie(r, csrfCookie)
+	header := r.Header.Get(csrfHeader)
+
+	return cookie != "" && subtle.ConstantTimeCompare([]byte(cookie), []byte(header)) == 1
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"backend/models"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Finds the cookie a response set, nil when it did not set it
+func responseCookie(w *httptest.ResponseRecorder, name string) *http.Cookie {
+	var found *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == name {
+			found = c
+		}
+	}
+	return found
+}
+
+// A session cookie that no longer verifies must not stand between the
+// browser and the routes it needs to sign in again
+func TestAuthenticateStaleSessionCookie(t *testing.T) {
+	app := newOAuthTestApp(nil, oauthProvider{})
+
+	var got *models.User
+	handler := app.authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = app.contextGetUser(r)
+	}))
+
+	// Not an opaque token, so it is checked as a JWT and fails without a database
+	r := httptest.NewRequest(http.MethodPost, "/v1/tokens/authentication", strings.NewReader("{}"))
+	r.AddCookie(&http.Cookie{Name: sessionCookie, Value: "stale.session.cookie"})
+	r.AddCookie(&http.Cookie{Name: csrfCookie, Value: "old-csrf"})
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if got == nil || !got.IsAnonymous() {
+		t.Fatalf("status = %d, user = %+v, want the anonymous user", w.Code, got)
+	}
+
+	for _, name := range []string{sessionCookie, refreshCookie, csrfCookie} {
+		if c := responseCookie(w, name); c == nil || c.MaxAge >= 0 {
+			t.Errorf("%s cookie = %+v, want it cleared", name, c)
+		}
+	}
+}
+
+// Point TEST_DB_DSN at a migrated database to run this
+func TestLoginAfterRevokedSessionCookie(t *testing.T) {
+	dsn := os.Getenv("TEST_DB_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DB_DSN not set")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	app := newOAuthTestApp(db, oauthProvider{})
+	app.config.Lockout.Threshold = 5
+	app.config.Lockout.IPThreshold = 20
+	app.config.Lockout.Duration = time.Minute
+	handler := app.routes()
+
+	suffix := time.Now().UnixNano()
+	password := fmt.Sprintf("correct horse battery %d", suffix)
+
+	user := &models.User{Name: "cookie", Email: fmt.Sprintf("cookie-%d@example.com", suffix), Activated: true}
+	if err := user.Password.Set(password); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.models.DB.InsertWithPermissions(user); err != nil {
+		t.Fatal(err)
+	}
+
+	login := func(cookies []*http.Cookie) *httptest.ResponseRecorder {
+		body := fmt.Sprintf(`{"email": %q, "password": %q}`, user.Email, password)
+
+		r := httptest.NewRequest(http.MethodPost, "/v1/tokens/authentication", strings.NewReader(body))
+		r.Header.Set(sessionModeHeader, "cookie")
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	w := login(nil)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("login status = %d: %s", w.Code, w.Body)
+	}
+	cookies := w.Result().Cookies()
+
+	// Signing out everywhere revokes the session the browser still holds
+	if err := app.models.DB.DeleteAlForUser(models.ScopeAuthentication, user.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// No CSRF header either, the stale cookies should count for nothing
+	w = login(cookies)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("login with a revoked cookie status = %d: %s", w.Code, w.Body)
+	}
+
+	// The new session is set after the stale one is cleared, so it wins
+	if c := responseCookie(w, sessionCookie); c == nil || c.Value == "" {
+		t.Errorf("session cookie = %+v, want a new session", c)
+	}
+}
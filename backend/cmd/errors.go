@@ -1,8 +1,12 @@
 package main
 
 import (
+	"backend/models"
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 // Generic helper for logging an error message
@@ -64,6 +68,15 @@ func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http
 	app.errorResponse(w, r, http.StatusTooManyRequests, message)
 }
 
+// Too many failed logins, the client is told when it may try again
+func (app *application) tooManyLoginAttemptsResponse(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+
+	message := fmt.Sprintf("too many failed login attempts, try again in %d seconds", seconds)
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
+
 func (app *application) invalidCredentialResponse(w http.ResponseWriter, r *http.Request) {
 	message := "invalid authentication credentials"
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
@@ -91,3 +104,40 @@ func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Requ
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
 
+// This is when the account is waiting out its deletion grace period
+func (app *application) accountPendingDeletionResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this account is scheduled for deletion, use the link we emailed you to cancel"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+// This is when an admin has suspended the account
+func (app *application) accountSuspendedResponse(w http.ResponseWriter, r *http.Request, user *models.User) {
+	message := envelope{
+		"message": "your account has been suspended",
+		"reason":  user.SuspensionReason,
+	}
+
+	if user.SuspendedUntil != nil {
+		message["suspended_until"] = user.SuspendedUntil
+	}
+
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+// JWTs skip the MFA exchange so accounts with 2FA have to use opaque tokens
+func (app *application) mfaRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	message := "two-factor authentication is enabled, use the /v1/tokens/authentication endpoint"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+// Cookie authenticated writes must carry the CSRF token in a header
+func (app *application) invalidCSRFTokenResponse(w http.ResponseWriter, r *http.Request) {
+	message := "missing or invalid CSRF token"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+// Account and credential management needs a real login, not an API key
+func (app *application) interactiveSessionRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	message := "API keys can not be used on this route, sign in instead"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"archive/zip"
+	"backend/validator"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Streams everything we hold about the logged in user as a ZIP of JSON files
+// or as a single JSON document. Resource rows are written as they are read
+func (app *application) exportCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	v := validator.New()
+
+	format := app.readString(r.URL.Query(), "format", "zip")
+	if v.Check(validator.In(format, "zip", "json"), "format", "must be either zip or json"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Fetch the small sections up front so we can still send a proper error
+	permissions, err := app.models.DB.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	tokens, err := app.models.DB.GetTokenMetadataForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	sections := []struct {
+		name string
+		data interface{}
+	}{
+		{"user", user},
+		{"permissions", permissions},
+		{"tokens", tokens},
+	}
+
+	filename := fmt.Sprintf("user-%d-export.%s", user.ID, format)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+
+	// Once the body has started the status is sent, so failures can only be logged
+	switch format {
+	case "zip":
+		w.Header().Set("Content-Type", "application/zip")
+		w.WriteHeader(http.StatusOK)
+
+		zw := zip.NewWriter(w)
+
+		for _, section := range sections {
+			f, err := zw.Create(section.name + ".json")
+			if err != nil {
+				app.logError(r, err)
+				return
+			}
+
+			if err = json.NewEncoder(f).Encode(section.data); err != nil {
+				app.logError(r, err)
+				return
+			}
+		}
+
+		for _, res := range app.resources() {
+			f, err := zw.Create(res.exportName() + ".json")
+			if err != nil {
+				app.logError(r, err)
+				return
+			}
+
+			if err = res.export(f, user.ID); err != nil {
+				app.logError(r, err)
+				return
+			}
+		}
+
+		if err = zw.Close(); err != nil {
+			app.logError(r, err)
+		}
+
+	case "json":
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+
+		io.WriteString(w, "{")
+
+		for _, section := range sections {
+			js, err := json.Marshal(section.data)
+			if err != nil {
+				app.logError(r, err)
+				return
+			}
+
+			fmt.Fprintf(w, "%q:%s,", section.name, js)
+		}
+
+		for i, res := range app.resources() {
+			if i > 0 {
+				io.WriteString(w, ",")
+			}
+
+			fmt.Fprintf(w, "%q:", res.exportName())
+
+			if err = res.export(w, user.ID); err != nil {
+				app.logError(r, err)
+				return
+			}
+		}
+
+		io.WriteString(w, "}\n")
+	}
+}
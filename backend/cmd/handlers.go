@@ -5,10 +5,6 @@ import (
 	"backend/validator"
 	"encoding/json"
 	"errors"
-	//"fmt"
-	//"github.com/pascaldekloe/jwt"
-	//"golang.org/x/crypto/bcrypt"
-	"log"
 	"net/http"
 	"time"
 )
@@ -18,19 +14,6 @@ type JSONMessage struct {
 	Message string `json:"message"`
 }
 
-// Create a register user type
-type UserPayload struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
-}
-
-// Create a generic DBLoad type
-type DBLoadPayload struct {
-	DBDataOne   string `json:"db_data_one"`
-	DBDataTwo   string `json:"db_data_two"`
-	DBDataThree string `json:"db_data_three"`
-}
-
 func (app *application) statusHandler(w http.ResponseWriter, r *http.Request) {
 	response := struct {
 		Status string
@@ -78,7 +61,8 @@ func (app *application) registerUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = app.models.DB.Insert(user)
+	// New users can read data out of the box, writing has to be granted
+	err = app.models.DB.InsertWithPermissions(user, "dataload:read")
 	if err != nil {
 		switch {
 		case errors.Is(err, models.ErrDuplicateEmail):
@@ -97,19 +81,17 @@ func (app *application) registerUser(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// THIS IS WHERE WE SEND TO OUR SMTP
-	// TODO: How to recover PANICS
-
-	go func(){
+	app.background(func() {
 		data := map[string]interface{}{
 			"activationToken": token.Plaintext,
 			"userID": user.ID,
 		}
 
-		err = app.mailer.Send(user.Email, "user_welcome.tmpl", data)
+		err := app.mailer.Send(user.Email, "user_welcome.tmpl", data)
 		if err != nil {
 			app.logger.PrintError(err, nil)
 		}
-	}()
+	})
 
 	err = app.writeJSON(w, http.StatusAccepted, envelope{"user":user}, nil)
 	if err != nil {
@@ -117,219 +99,42 @@ func (app *application) registerUser(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// This function is client side - to - database
-func (app *application) getData(w http.ResponseWriter, r *http.Request) {
-	id, err := app.readIDParam(r)
-	if err != nil {
-		app.notFoundResponse(w, r)
-		return
-	}
-
-	data, err := app.models.DB.GetData(id)
-	if err != nil {
-		switch {
-		case errors.Is(err, models.ErrRecordNotFound):
-			app.notFoundResponse(w, r)
-		default:
-			app.serverErrorResponse(w, r, err)
-		}
-		return
-	}
-
-	err = app.writeJSON(w, http.StatusOK, envelope{"data": data}, nil)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
+func (app *application) activateUser(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
 	}
-}
 
-// TODO: Refactor this aswell
-//func (app *application) login(w http.ResponseWriter, r *http.Request) {
-	//var payload UserPayload
-
-	//err := json.NewDecoder(r.Body).Decode(&payload)
-	//if err != nil {
-		//app.logger.PrintError(err, nil)
-	//}
-
-	////we need to get the user
-	//// TODO: replace with get usr by email
-	//user, err := app.models.DB.GetUser(payload.Username)
-	//if err != nil {
-		//app.logger.PrintInfo("User does not exist", nil)
-		//return
-	//}
-
-	//hashPassword := user.Password
-
-	//err = bcrypt.CompareHashAndPassword([]byte(hashPassword), []byte(payload.Password))
-	//// Handle the error for hasing and comparing
-	//if err != nil {
-		//log.Println(err)
-		//_message := JSONMessage{
-			//Message: "Unauthorized",
-		//}
-
-		//js, err := json.MarshalIndent(_message, "", "\t")
-		//if err != nil {
-			//app.logger.PrintError(err, nil)
-		//}
-
-		//w.Header().Set("Context-Type", "application/json")
-		//w.WriteHeader(http.StatusOK)
-		//w.Write(js)
-		//return
-	//}
-
-	//// Validating a users token
-	//var claims jwt.Claims
-	//claims.Subject = fmt.Sprint(user.ID)
-	//claims.Issued = jwt.NewNumericTime(time.Now())
-	//claims.NotBefore = jwt.NewNumericTime(time.Now())
-	//claims.Expires = jwt.NewNumericTime(time.Now().Add(24 * time.Hour))
-	//// supposed to be a unique domain you own
-	//claims.Issuer = "github.com/melkeydev"
-	//claims.Audiences = []string{"github.com/melkeydev"}
-
-	//jwtBytes, err := claims.HMACSign(jwt.HS256, []byte(app.config.Jwt.Secret))
-	//if err != nil {
-		//fmt.Println(err)
-		//message := "Could not generate proper access"
-		//app.errorResponse(w, r, http.StatusInternalServerError, message)
-		//return
-	//}
-
-	////app.writeJSON(w, http.StatusOK, string(jwtBytes), "Successfully logged in")
-	//_message := JSONMessage{
-		//Message: string(jwtBytes),
-	//}
-
-	//js, err := json.MarshalIndent(_message, "", "\t")
-	//if err != nil {
-		//app.logger.PrintError(err, nil)
-	//}
-
-	//w.Header().Set("Context-Type", "application/json")
-	//w.WriteHeader(http.StatusOK)
-	//w.Write(js)
-
-//}
-
-func (app *application) insertPayload(w http.ResponseWriter, r *http.Request) {
-	var payload DBLoadPayload
-
-	err := json.NewDecoder(r.Body).Decode(&payload)
+	err := app.readJSON(w, r, &input)
 	if err != nil {
-		log.Println(err)
+		app.badRequestResponse(w, r, err)
 		return
 	}
 
-	dbload := &models.DBLoad{
-		DBDataOne:   payload.DBDataOne,
-		DBDataTwo:   payload.DBDataTwo,
-		DBDataThree: payload.DBDataThree,
-	}
-
 	v := validator.New()
 
-	if models.ValidateDBLoad(v, dbload); !v.Valid() {
+	if models.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	err = app.models.DB.InsertDBLoad(dbload)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
-	}
-
-	err = app.writeJSON(w, http.StatusOK, envelope{"data": dbload}, nil)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-	}
-}
-
-func (app *application) deleteDBload(w http.ResponseWriter, r *http.Request) {
-	id, err := app.readIDParam(r)
-	if err != nil {
-		app.notFoundResponse(w, r)
-	}
-
-	err = app.models.DB.Delete(id)
-	if err != nil {
-		switch {
-		case errors.Is(err, models.ErrRecordNotFound):
-			app.notFoundResponse(w, r)
-		default:
-			app.serverErrorResponse(w, r, err)
-		}
-		return
-	}
-
-	err = app.writeJSON(w, http.StatusOK, envelope{"message": "data deleted Succesfully"}, nil)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-	}
-}
-
-func (app *application) updateDBData(w http.ResponseWriter, r *http.Request) {
-	id, err := app.readIDParam(r)
-	if err != nil {
-		app.notFoundResponse(w, r)
-		return
-	}
-
-	// This is where we pull all the data first to update
-	data, err := app.models.DB.GetData(id)
+	user, err := app.models.DB.GetForToken(models.ScopeActivation, input.TokenPlaintext)
 	if err != nil {
-		switch {
+		switch{
 		case errors.Is(err, models.ErrRecordNotFound):
-			app.notFoundResponse(w, r)
+			v.AddError("token", "invalid or expire auth token")
+			app.failedValidationResponse(w, r, v.Errors)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
 
-	var input struct {
-		DBDataOne   *string `json:"db_data_one"`
-		DBDataTwo   *string `json:"db_data_two"`
-		DBDataThree *string `json:"db_data_three"`
-	}
-
-	err = app.readJSON(w, r, &input)
-	if err != nil {
-		app.badRequestResponse(w, r, err)
-		return
-	}
-
-	// Explicitly check each input
-	if input.DBDataOne != nil {
-		data.DBDataOne = *input.DBDataOne
-	}
-
-	if input.DBDataTwo != nil {
-		data.DBDataTwo = *input.DBDataTwo
-	}
-
-	if input.DBDataThree != nil {
-		data.DBDataThree = *input.DBDataThree
-	}
-
-	data.ID = id
-
-	v := validator.New()
-
-	// validate the json data
-	if models.ValidateDBLoad(v, data); !v.Valid() {
-		app.failedValidationResponse(w, r, v.Errors)
-		return
-	}
+	user.Activated = true
 
 	// This needs to change
-	err = app.models.DB.Update(data)
+	err = app.models.DB.UpdateUser(user)
 	if err != nil {
 		switch {
-		// the race condition editing error message
 		case errors.Is(err, models.ErrEditConflict):
 			app.editConflictResponse(w, r)
 		default:
@@ -338,51 +143,21 @@ func (app *application) updateDBData(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"data": data}, nil)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-	}
-}
-
-func (app *application) listAllDBData(w http.ResponseWriter, r *http.Request) {
-	var input struct {
-		DBDataOne string
-		models.Filters
-	}
-
-	v := validator.New()
-	qs := r.URL.Query()
-
-	// Query string readers go below
-	input.DBDataOne = app.readString(qs, "dbdataone", "")
-
-	input.Filters.Page = app.readInt(qs, "page", 1, v)
-	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
-
-	input.Filters.Sort = app.readString(qs, "sort", "id")
-	input.Filters.SortSafeList = []string{"id", "DBDataOne"}
-
-	if models.ValidateFilters(v, input.Filters); !v.Valid() {
-		app.failedValidationResponse(w, r, v.Errors)
-		return
-	}
-	// We need to get all
-
-	DBdata, metadata, err := app.models.DB.GetAll(input.DBDataOne, input.Filters)
+	err = app.models.DB.DeleteAlForUser(models.ScopeActivation, user.ID)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"DBdata": DBdata, "metadata": metadata}, nil)
-
+	err = app.writeJSON(w, http.StatusOK, envelope{"user":user}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
 
-func (app *application) activateUser(w http.ResponseWriter, r *http.Request) {
+func (app *application) updateUserPassword(w http.ResponseWriter, r *http.Request) {
 	var input struct {
+		Password       string `json:"password"`
 		TokenPlaintext string `json:"token"`
 	}
 
@@ -394,16 +169,19 @@ func (app *application) activateUser(w http.ResponseWriter, r *http.Request) {
 
 	v := validator.New()
 
-	if models.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+	models.ValidatePasswordPlaintext(v, input.Password)
+	models.ValidateTokenPlaintext(v, input.TokenPlaintext)
+
+	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	user, err := app.models.DB.GetForToken(models.ScopeActivation, input.TokenPlaintext)
+	user, err := app.models.DB.GetForToken(models.ScopePasswordReset, input.TokenPlaintext)
 	if err != nil {
-		switch{
+		switch {
 		case errors.Is(err, models.ErrRecordNotFound):
-			v.AddError("token", "invalid or expire auth token")
+			v.AddError("token", "invalid or expired password reset token")
 			app.failedValidationResponse(w, r, v.Errors)
 		default:
 			app.serverErrorResponse(w, r, err)
@@ -411,9 +189,18 @@ func (app *application) activateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user.Activated = true
+	// The strength rules need the user's name and email, so they run once the token checks out
+	if models.ValidateNewPassword(v, input.Password, user); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = user.Password.Set(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
 
-	// This needs to change
 	err = app.models.DB.UpdateUser(user)
 	if err != nil {
 		switch {
@@ -425,22 +212,23 @@ func (app *application) activateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = app.models.DB.DeleteAlForUser(models.ScopeActivation, user.ID)
+	// The reset token is single use and any existing sessions are now suspect
+	for _, scope := range []string{models.ScopePasswordReset, models.ScopeAuthentication, models.ScopeRefresh} {
+		err = app.models.DB.DeleteAlForUser(scope, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err = app.models.DB.RevokeJWTs(user.ID)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"user":user}, nil)
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "your password was successfully reset"}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
-
-
-
-
-
-
-
-
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"backend/models"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Failed logins are tracked against both the email and the client IP so one
+// address cannot be hammered and one client cannot spray many addresses
+func loginKeys(r *http.Request, email string) (emailKey, ipKey string) {
+	emailKey = "email:" + strings.ToLower(email)
+
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		ipKey = "ip:" + ip
+	}
+
+	return emailKey, ipKey
+}
+
+// loginRetryAfter returns how long the caller must wait before trying again.
+// Each failure doubles the wait until the threshold locks the key outright
+func (app *application) loginRetryAfter(keys ...string) (time.Duration, error) {
+	var wait time.Duration
+
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+
+		attempt, err := app.models.DB.GetLoginAttempt(key)
+		if err != nil {
+			if errors.Is(err, models.ErrRecordNotFound) {
+				continue
+			}
+			return 0, err
+		}
+
+		if attempt.LockedUntil != nil {
+			if remaining := time.Until(*attempt.LockedUntil); remaining > wait {
+				wait = remaining
+			}
+		}
+
+		if attempt.Failures > 0 {
+			// Cap the shift so huge failure counts cannot overflow
+			shift := attempt.Failures - 1
+			if shift > 20 {
+				shift = 20
+			}
+
+			backoff := app.config.Lockout.Backoff << shift
+			if backoff > app.config.Lockout.Duration {
+				backoff = app.config.Lockout.Duration
+			}
+
+			if remaining := time.Until(attempt.LastFailureAt.Add(backoff)); remaining > wait {
+				wait = remaining
+			}
+		}
+	}
+
+	return wait, nil
+}
+
+// recordLoginFailure counts the failure against both keys and locks whichever
+// crossed its threshold. The owner is emailed when their account gets locked
+func (app *application) recordLoginFailure(emailKey, ipKey string, user *models.User) error {
+	thresholds := map[string]int{
+		emailKey: app.config.Lockout.Threshold,
+		ipKey:    app.config.Lockout.IPThreshold,
+	}
+
+	for key, threshold := range thresholds {
+		if key == "" {
+			continue
+		}
+
+		attempt, err := app.models.DB.RecordLoginFailure(key)
+		if err != nil {
+			return err
+		}
+
+		if attempt.Failures < threshold {
+			continue
+		}
+
+		lockedUntil := time.Now().Add(app.config.Lockout.Duration)
+
+		err = app.models.DB.LockLogin(key, lockedUntil)
+		if err != nil {
+			return err
+		}
+
+		if key == emailKey && user != nil {
+			app.background(func() {
+				data := map[string]interface{}{
+					"name":        user.Name,
+					"lockedUntil": lockedUntil.UTC().Format(time.RFC1123),
+				}
+
+				err := app.mailer.Send(user.Email, "user_account_locked.tmpl", data)
+				if err != nil {
+					app.logger.PrintError(err, nil)
+				}
+			})
+		}
+	}
+
+	return nil
+}
+
+// clearLoginFailures resets key after a successful login and forgives the IP
+// the failures that key had built up. Everyone behind a shared NAT counts
+// against one IP key, so without this the typos of users who then got in
+// would add up until the whole network was backed off. Failures from other
+// keys stay, so spraying many addresses from one IP is still caught
+func (app *application) clearLoginFailures(key, ipKey string) error {
+	attempt, err := app.models.DB.GetLoginAttempt(key)
+	if err != nil {
+		if errors.Is(err, models.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	if ipKey != "" && attempt.Failures > 0 {
+		err = app.models.DB.ForgiveLoginFailures(ipKey, attempt.Failures)
+		if err != nil {
+			return err
+		}
+	}
+
+	return app.models.DB.ClearLoginFailures(key)
+}
@@ -5,11 +5,15 @@ import (
 	"backend/mailer"
 	"backend/models"
 	"backend/types"
+	"backend/validator"
+	"errors"
 	"flag"
 	"fmt"
 	_ "github.com/lib/pq"
+	"golang.org/x/crypto/bcrypt"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 )
 
@@ -18,6 +22,11 @@ type application struct {
 	logger *jsonlog.Logger
 	models models.Models
 	mailer mailer.Mailer
+
+	activationThrottle *throttle
+	magicLinkThrottle  *throttle
+	sessions           *sessionTracker
+	oauthProviders     map[string]oauthProvider
 }
 
 func main() {
@@ -33,6 +42,44 @@ func main() {
 	// CHANGE DSN to your database setting
 	flag.StringVar(&cfg.Db.Dsn, "dsn", "host=localhost user=postgres password=postgres dbname=postgres port=5432 sslmode=disable", "Database connection string")
 	flag.StringVar(&cfg.Jwt.Secret, "jwt-secret", "default-secret", "secret-key")
+	flag.StringVar(&cfg.AdminEmail, "admin-email", "", "existing user to grant users:admin on startup")
+
+	flag.IntVar(&cfg.Password.MinLength, "password-min-length", 8, "shortest password users may pick")
+	flag.IntVar(&cfg.Password.MinClasses, "password-min-classes", 2, "character classes (lower, upper, digit, symbol) a new password needs")
+	flag.Float64Var(&cfg.Password.MinEntropy, "password-min-entropy", 40, "estimated bits of entropy a new password needs")
+	flag.StringVar(&cfg.Password.BreachedFile, "password-breached-file", "", "file of breached password SHA-1 hashes, one per line, or a directory of Pwned Passwords range files")
+
+	flag.StringVar(&cfg.Password.Hasher, "password-hasher", "argon2id", "algorithm for new password hashes (argon2id|bcrypt)")
+	flag.IntVar(&cfg.Password.BcryptCost, "bcrypt-cost", 12, "bcrypt cost when the bcrypt hasher is used")
+	flag.UintVar(&cfg.Password.Argon2.Memory, "argon2-memory", 64*1024, "argon2id memory in KiB")
+	flag.UintVar(&cfg.Password.Argon2.Iterations, "argon2-iterations", 3, "argon2id passes over the memory")
+	flag.UintVar(&cfg.Password.Argon2.Parallelism, "argon2-parallelism", 2, "argon2id threads")
+
+	flag.IntVar(&cfg.Lockout.Threshold, "lockout-threshold", 5, "failed logins before an email is locked")
+	flag.IntVar(&cfg.Lockout.IPThreshold, "lockout-ip-threshold", 20, "failed logins before an IP is locked")
+	flag.DurationVar(&cfg.Lockout.Duration, "lockout-duration", 15*time.Minute, "how long a lockout lasts")
+	flag.DurationVar(&cfg.Lockout.Backoff, "lockout-backoff", time.Second, "wait after the first failed login, doubled for each failure")
+
+	flag.StringVar(&cfg.Cookie.Domain, "cookie-domain", "", "domain for the session cookies, empty means the API host")
+
+	// Cookies only travel cross origin to origins we name, never to "*"
+	flag.Func("cors-trusted-origins", "trusted CORS origins (space separated)", func(val string) error {
+		cfg.Cors.TrustedOrigins = strings.Fields(val)
+		return nil
+	})
+
+	flag.IntVar(&cfg.Deletion.GraceDays, "deletion-grace-days", 30, "days before a deleted account is purged")
+
+	// Point an issuer at a local mock OIDC server to try sign in without Google
+	flag.StringVar(&cfg.OAuth.RedirectURL, "oauth-redirect-url", "http://localhost:3000/oauth", "frontend callback URL, the provider name is appended")
+	flag.StringVar(&cfg.OAuth.Google.Issuer, "oauth-google-issuer", "https://accounts.google.com", "OIDC issuer URL for Google sign in")
+	flag.StringVar(&cfg.OAuth.Google.ClientID, "oauth-google-client-id", "", "Google OAuth client ID")
+	flag.StringVar(&cfg.OAuth.Google.ClientSecret, "oauth-google-client-secret", "", "Google OAuth client secret")
+	flag.StringVar(&cfg.OAuth.GitHub.Issuer, "oauth-github-url", "https://github.com", "GitHub or GitHub Enterprise base URL")
+	flag.StringVar(&cfg.OAuth.GitHub.ClientID, "oauth-github-client-id", "", "GitHub OAuth client ID")
+	flag.StringVar(&cfg.OAuth.GitHub.ClientSecret, "oauth-github-client-secret", "", "GitHub OAuth client secret")
+	flag.BoolVar(&cfg.OAuth.Google.AutoLink, "oauth-google-auto-link", false, "link Google sign ins to existing accounts with the same verified email")
+	flag.BoolVar(&cfg.OAuth.GitHub.AutoLink, "oauth-github-auto-link", false, "link GitHub sign ins to existing accounts with the same verified email")
 
 	// create flags
 	flag.StringVar(&cfg.SMTP.Host, "smtp-host", "smtp.mailtrap.io", "SMTP host")
@@ -44,6 +91,59 @@ func main() {
 
 	flag.Parse()
 
+	// Anyone can sign a JWT with the default secret
+	if cfg.Jwt.Secret == "default-secret" && cfg.Env != "development" {
+		logger.PrintFatal(errors.New("-jwt-secret must be set outside development"), nil)
+	}
+
+	// A zero grace period would purge accounts the moment they are deleted
+	if cfg.Deletion.GraceDays < 1 {
+		logger.PrintFatal(errors.New("-deletion-grace-days must be at least 1"), nil)
+	}
+
+	// Existing hashes keep working, they move to this one as users log in
+	switch cfg.Password.Hasher {
+	case "argon2id":
+		a := cfg.Password.Argon2
+
+		// argon2 panics on parameters outside these bounds
+		switch {
+		case a.Parallelism < 1 || a.Parallelism > 255:
+			logger.PrintFatal(errors.New("-argon2-parallelism must be between 1 and 255"), nil)
+		case a.Memory == 0 || a.Memory < 8*a.Parallelism:
+			logger.PrintFatal(errors.New("-argon2-memory must be at least 8 KiB per thread"), nil)
+		case a.Iterations == 0:
+			logger.PrintFatal(errors.New("-argon2-iterations must be at least 1"), nil)
+		}
+
+		models.PasswordHasher = models.NewArgon2id(uint32(cfg.Password.Argon2.Memory), uint32(cfg.Password.Argon2.Iterations), uint8(cfg.Password.Argon2.Parallelism))
+	case "bcrypt":
+		// bcrypt silently swaps a cost below the minimum for its default
+		if cfg.Password.BcryptCost < bcrypt.MinCost || cfg.Password.BcryptCost > bcrypt.MaxCost {
+			logger.PrintFatal(fmt.Errorf("-bcrypt-cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost), nil)
+		}
+
+		models.PasswordHasher = models.Bcrypt{Cost: cfg.Password.BcryptCost}
+	default:
+		logger.PrintFatal(fmt.Errorf("unknown password hasher %q", cfg.Password.Hasher), nil)
+	}
+
+	models.PasswordPolicy = &validator.PasswordPolicy{
+		MinLength:  cfg.Password.MinLength,
+		MinClasses: cfg.Password.MinClasses,
+		MinEntropy: cfg.Password.MinEntropy,
+	}
+
+	if cfg.Password.BreachedFile != "" {
+		breached, err := validator.LoadBreachedPasswords(cfg.Password.BreachedFile)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+
+		models.PasswordPolicy.Breached = breached
+		logger.PrintInfo(fmt.Sprintf("loaded %d breached password hashes", breached.Len()), nil)
+	}
+
 	db, err := connectDB(cfg)
 	if err != nil {
 		logger.PrintFatal(err, nil)
@@ -56,8 +156,25 @@ func main() {
 		logger: logger,
 		models: models.NewModels(db),
 		mailer: mailer.New(cfg.SMTP.Host, cfg.SMTP.Port, cfg.SMTP.Username, cfg.SMTP.Password, cfg.SMTP.Sender),
+
+		activationThrottle: newThrottle(5 * time.Minute),
+		magicLinkThrottle:  newThrottle(time.Minute),
+		sessions:           newSessionTracker(),
+		oauthProviders:     newOAuthProviders(cfg),
 	}
 
+	if cfg.AdminEmail != "" {
+		err = app.bootstrapAdmin(cfg.AdminEmail)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+	}
+
+	// Hard delete accounts once their grace period runs out
+	app.background(app.purgeDeletedUsers)
+	app.background(app.purgeLoginAttempts)
+	app.background(app.flushSessions)
+
 	// Declare Server config
 	server := http.Server{
 		Addr:         fmt.Sprintf(":%d", cfg.Port),
@@ -16,8 +16,25 @@ import (
 // We did not fully test this
 func (app *application) enableCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type,Authorization")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type,Authorization,X-API-Key,X-CSRF-Token,X-Session-Mode")
+
+		if len(app.config.Cors.TrustedOrigins) == 0 {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+
+		origin := r.Header.Get("Origin")
+		for _, trusted := range app.config.Cors.TrustedOrigins {
+			if origin != "" && origin == trusted {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+				break
+			}
+		}
+
 		next.ServeHTTP(w, r)
 	})
 }
@@ -100,38 +117,67 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		// Adding ther VARY and AUTHORIZATION
 		// This indicates to any cache that the request may vary
 		w.Header().Add("Vary", "Authorization")
+		w.Header().Add("Vary", "X-API-Key")
 
 		// Retrieve the value of the Authorization header
 		authorizationHeader := r.Header.Get("Authorization")
 
+		// Machine clients can send their API key on its own header instead
+		apiKeyHeader := r.Header.Get("X-API-Key")
+
+		// Browsers in cookie mode send the session cookie instead
+		sessionCookieValue := ""
+		if authorizationHeader == "" && apiKeyHeader == "" {
+			sessionCookieValue = app.readCookie(r, sessionCookie)
+		}
+
 		// The pointer reference might be questionable
 		// IF there is no authorizationHeader we will set the context
 		// this will hold an AnonymousUser - gifting bare minimum
-		if authorizationHeader == "" {
+		if authorizationHeader == "" && apiKeyHeader == "" && sessionCookieValue == "" {
 			r = app.contextSetUser(r, models.AnonymousUser)
 			next.ServeHTTP(w, r)
 			return
 		}
 
-		headerParts := strings.Split(authorizationHeader, " ")
-		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
+		token := apiKeyHeader
+		if sessionCookieValue != "" {
+			token = sessionCookieValue
+		} else if authorizationHeader != "" {
+			var ok bool
+			token, ok = app.readBearerToken(r)
+			if !ok {
+				app.invalidCredentialResponse(w, r)
+				return
+			}
+		} else if !models.IsAPIKey(token) {
 			app.invalidCredentialResponse(w, r)
 			return
 		}
 
-		token := headerParts[1]
-		v := validator.New()
+		// API keys carry a prefix, opaque tokens are always 26 chars and
+		// anything else we treat as a JWT
+		var user *models.User
+		var err error
 
-		// We need to validate the token to make sure it is correct format
-		if models.ValidateTokenPlaintext(v, token); !v.Valid() {
-			app.invalidCredentialResponse(w, r)
-			return
+		if models.IsAPIKey(token) {
+			var key *models.APIKey
+			user, key, err = app.models.DB.GetForAPIKey(token)
+			if err == nil {
+				r = app.contextSetAPIKey(r, key)
+			}
+		} else {
+			user, err = app.userForBearerToken(token)
 		}
 
-		// then we need to get the user
-		user, err := app.models.DB.GetForToken(models.ScopeAuthentication, token)
 		if err != nil {
 			switch {
+			// A revoked or expired cookie would otherwise lock the browser out
+			// of the very routes it needs to sign in again
+			case errors.Is(err, models.ErrRecordNotFound) && sessionCookieValue != "":
+				app.clearSessionCookies(w)
+				r = app.contextSetUser(r, models.AnonymousUser)
+				next.ServeHTTP(w, r)
 			case errors.Is(err, models.ErrRecordNotFound):
 				app.invalidAuthenticationTokenResponse(w, r)
 			default:
@@ -140,6 +186,23 @@ func (app *application) authenticate(next http.Handler) http.Handler {
       return
 		}
 
+		// The browser attaches cookies to forged requests too
+		if sessionCookieValue != "" && !app.validCSRF(r) {
+			app.invalidCSRFTokenResponse(w, r)
+			return
+		}
+
+		// Stateless JWTs outlive revoked tokens so these are checked on every request
+		if user.IsPendingDeletion() {
+			app.accountPendingDeletionResponse(w, r)
+			return
+		}
+
+		if user.IsSuspended() {
+			app.accountSuspendedResponse(w, r, user)
+			return
+		}
+
     // Set the user here pointer ref is questionable
     r = app.contextSetUser(r, user)
 
@@ -148,6 +211,47 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 	})
 }
 
+// Pulls the token out of an "Authorization: Bearer <token>" header
+func (app *application) readBearerToken(r *http.Request) (string, bool) {
+	headerParts := strings.Split(r.Header.Get("Authorization"), " ")
+	if len(headerParts) != 2 || headerParts[0] != "Bearer" {
+		return "", false
+	}
+
+	return headerParts[1], true
+}
+
+// Looks up the user for either a stored opaque token or a signed JWT
+func (app *application) userForBearerToken(token string) (*models.User, error) {
+	v := validator.New()
+
+	// A well formed opaque token goes to the tokens table
+	if models.ValidateTokenPlaintext(v, token); v.Valid() {
+		user, err := app.models.DB.GetForToken(models.ScopeAuthentication, token)
+		if err == nil {
+			app.sessions.Touch(token)
+		}
+		return user, err
+	}
+
+	userID, version, err := app.verifyJWT(token)
+	if err != nil {
+		return nil, models.ErrRecordNotFound
+	}
+
+	user, err := app.models.DB.GetUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Logging out, signing out everywhere or changing the password bumps the version
+	if user.TokenVersion != version {
+		return nil, models.ErrRecordNotFound
+	}
+
+	return user, nil
+}
+
 // We need to split our auth to handle activated routes and authenticated routes
 func(app *application) requireAuthenticatedUser(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -178,3 +282,63 @@ func (app *application) requireActivatedUser(next http.HandlerFunc) http.Handler
 
 	return app.requireAuthenticatedUser(fn)
 }
+
+// Keeps API keys off the self-service routes. Without this a leaked key could
+// change the password, turn off 2FA or mint more keys for its owner
+func (app *application) requireInteractiveSession(next http.HandlerFunc) http.HandlerFunc {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if app.contextGetAPIKey(r) != nil {
+			app.interactiveSessionRequiredResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+
+	return app.requireAuthenticatedUser(fn)
+}
+
+// Checks the activated user holds the permission code before calling next
+func (app *application) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		permissions, err := app.requestPermissions(r)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if !permissions.Include(code) {
+			app.notPermittedResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+
+	return app.requireActivatedUser(fn)
+}
+
+// The permissions this request may use. API keys only get the codes listed
+// on the key that their owner also still holds
+func (app *application) requestPermissions(r *http.Request) (models.Permissions, error) {
+	user := app.contextGetUser(r)
+
+	permissions, err := app.models.DB.GetAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	key := app.contextGetAPIKey(r)
+	if key == nil {
+		return permissions, nil
+	}
+
+	allowed := models.Permissions{}
+	for _, code := range permissions {
+		if key.Permissions.Include(code) {
+			allowed = append(allowed, code)
+		}
+	}
+
+	return allowed, nil
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"backend/models"
+	"backend/oauth"
+	"backend/types"
+	"backend/validator"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// How long the user has to finish signing in at the provider
+const oauthStateTTL = 10 * time.Minute
+
+// The browser that started a sign in keeps a hash of its state here, so a
+// code and state lifted from someone else's attempt can not be replayed
+const (
+	oauthStateCookie     = "oauth_state"
+	oauthStateCookiePath = "/v1/oauth"
+)
+
+// oauthProvider is a configured provider plus how we treat its identities
+type oauthProvider struct {
+	oauth.Provider
+
+	// Link unknown identities to the account with the same verified email.
+	// Off by default, the provider then has to be linked while signed in
+	autoLink bool
+}
+
+// Sets up every provider that has a client ID configured
+func newOAuthProviders(cfg types.Config) map[string]oauthProvider {
+	providers := make(map[string]oauthProvider)
+
+	redirectURL := strings.TrimSuffix(cfg.OAuth.RedirectURL, "/")
+
+	if p := cfg.OAuth.Google; p.ClientID != "" {
+		providers["google"] = oauthProvider{
+			Provider: oauth.NewOIDC(p.Issuer, oauth.Config{
+				ClientID:     p.ClientID,
+				ClientSecret: p.ClientSecret,
+				RedirectURL:  redirectURL + "/google",
+			}),
+			autoLink: p.AutoLink,
+		}
+	}
+
+	if p := cfg.OAuth.GitHub; p.ClientID != "" {
+		providers["github"] = oauthProvider{
+			Provider: oauth.NewGitHub(p.Issuer, oauth.Config{
+				ClientID:     p.ClientID,
+				ClientSecret: p.ClientSecret,
+				RedirectURL:  redirectURL + "/github",
+			}),
+			autoLink: p.AutoLink,
+		}
+	}
+
+	return providers
+}
+
+// Looks up the provider named in the URL, sending a 404 for unknown ones
+func (app *application) readOAuthProvider(w http.ResponseWriter, r *http.Request) (string, oauthProvider, bool) {
+	name := httprouter.ParamsFromContext(r.Context()).ByName("provider")
+
+	provider, ok := app.oauthProviders[name]
+	if !ok {
+		app.notFoundResponse(w, r)
+		return "", oauthProvider{}, false
+	}
+
+	return name, provider, true
+}
+
+func oauthStateHash(state string) string {
+	sum := sha256.Sum256([]byte(state))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Checks the state came back to the same browser that started the sign in
+func (app *application) validOAuthState(r *http.Request, state string) bool {
+	cookie, err := r.Cookie(oauthStateCookie)
+	if err != nil || state == "" {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(oauthStateHash(state))) == 1
+}
+
+// Checks the state, then trades the code the provider redirected back with
+// for the identity that signed in. It writes the response on failure
+func (app *application) exchangeOAuthCode(w http.ResponseWriter, r *http.Request, name string, provider oauthProvider) (*oauth.Identity, bool) {
+	var input struct {
+		Code  string `json:"code"`
+		State string `json:"state"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return nil, false
+	}
+
+	v := validator.New()
+
+	v.Check(input.Code != "", "code", "must be provided")
+	v.Check(input.State != "", "state", "must be provided")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return nil, false
+	}
+
+	if v.Check(app.validOAuthState(r, input.State), "state", "this sign in was started in a different browser"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return nil, false
+	}
+
+	cookie := app.newCookie(oauthStateCookie, "", oauthStateCookiePath, time.Unix(0, 0), true)
+	cookie.MaxAge = -1
+	http.SetCookie(w, cookie)
+
+	verifier, err := app.models.DB.ConsumeOAuthState(name, input.State)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrRecordNotFound):
+			v.AddError("state", "invalid or expired sign in attempt")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	identity, err := provider.Exchange(r.Context(), input.Code, verifier)
+	if err != nil {
+		switch {
+		case errors.Is(err, oauth.ErrExchange):
+			app.logError(r, err)
+			app.invalidCredentialResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return identity, true
+}
+
+// Starts a sign in by handing the frontend the provider URL to redirect to
+func (app *application) createOAuthAuthorizationHandler(w http.ResponseWriter, r *http.Request) {
+	name, provider, ok := app.readOAuthProvider(w, r)
+	if !ok {
+		return
+	}
+
+	verifier, err := oauth.NewVerifier()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	state, err := app.models.DB.NewOAuthState(name, verifier, oauthStateTTL)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	authURL, err := provider.AuthCodeURL(r.Context(), state, verifier)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	http.SetCookie(w, app.newCookie(oauthStateCookie, oauthStateHash(state), oauthStateCookiePath, time.Now().Add(oauthStateTTL), true))
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"authorization_url": authURL, "state": state}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Finishes a sign in with the code and state the provider redirected back
+// with, creating the account the first time someone signs in this way
+func (app *application) createOAuthAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	name, provider, ok := app.readOAuthProvider(w, r)
+	if !ok {
+		return
+	}
+
+	identity, ok := app.exchangeOAuthCode(w, r, name, provider)
+	if !ok {
+		return
+	}
+
+	user, ok := app.userForIdentity(w, r, name, provider, identity)
+	if !ok {
+		return
+	}
+
+	if user.IsPendingDeletion() {
+		app.accountPendingDeletionResponse(w, r)
+		return
+	}
+
+	if user.IsSuspended() {
+		app.accountSuspendedResponse(w, r, user)
+		return
+	}
+
+	app.completeLogin(w, r, user)
+}
+
+// Finds the user behind an external identity. Unknown identities get a new
+// activated account, or are linked to the account with the same verified
+// email when the provider is trusted to auto link
+func (app *application) userForIdentity(w http.ResponseWriter, r *http.Request, name string, provider oauthProvider, identity *oauth.Identity) (*models.User, bool) {
+	user, err := app.models.DB.GetUserForIdentity(name, identity.Subject)
+	if err == nil {
+		return user, true
+	}
+
+	if !errors.Is(err, models.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return nil, false
+	}
+
+	v := validator.New()
+
+	// Without a verified email anyone could claim somebody else's account
+	if v.Check(identity.EmailVerified, "email", "the provider has not verified your email address"); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return nil, false
+	}
+
+	link := &models.Identity{
+		Provider: name,
+		Subject:  identity.Subject,
+		Email:    identity.Email,
+	}
+
+	user, err = app.models.DB.GetUserByEmail(identity.Email)
+	switch {
+	case err == nil:
+		// Otherwise anyone who controls an account at the provider with this
+		// address would walk straight into the existing account
+		if v.Check(provider.autoLink, "email", "an account with this email already exists, sign in and link "+name+" from your account"); !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return nil, false
+		}
+
+		// An unactivated account may have been registered by someone else
+		// with this address, so it must not inherit the external login
+		if v.Check(user.Activated, "email", "an account with this email exists but has not been activated"); !v.Valid() {
+			app.failedValidationResponse(w, r, v.Errors)
+			return nil, false
+		}
+
+		link.UserID = user.ID
+
+		err = app.models.DB.InsertIdentity(link)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return nil, false
+		}
+
+		return user, true
+
+	case !errors.Is(err, models.ErrRecordNotFound):
+		app.serverErrorResponse(w, r, err)
+		return nil, false
+	}
+
+	user = &models.User{
+		Name:      identity.Name,
+		Email:     identity.Email,
+		Activated: true,
+	}
+
+	if user.Name == "" {
+		user.Name = strings.SplitN(identity.Email, "@", 2)[0]
+	}
+
+	if len(user.Name) > 72 {
+		user.Name = user.Name[:72]
+	}
+
+	// Nobody knows this password, the account can only sign in through the
+	// provider until a password reset sets a real one
+	randomBytes := make([]byte, 48)
+
+	_, err = rand.Read(randomBytes)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return nil, false
+	}
+
+	err = user.Password.Set(base64.RawStdEncoding.EncodeToString(randomBytes)[:64])
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return nil, false
+	}
+
+	if models.ValidateUser(v, user); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return nil, false
+	}
+
+	// Same starting permissions as users who register with a password
+	err = app.models.DB.InsertUserWithIdentity(user, link, "dataload:read")
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return nil, false
+	}
+
+	return user, true
+}
+
+// Links a provider to the signed in account. The sign in is started with the
+// usual authorization endpoint and the code and state are posted here instead
+func (app *application) createIdentityHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	name, provider, ok := app.readOAuthProvider(w, r)
+	if !ok {
+		return
+	}
+
+	identity, ok := app.exchangeOAuthCode(w, r, name, provider)
+	if !ok {
+		return
+	}
+
+	link := &models.Identity{
+		UserID:   user.ID,
+		Provider: name,
+		Subject:  identity.Subject,
+		Email:    identity.Email,
+	}
+
+	v := validator.New()
+
+	err := app.models.DB.InsertIdentity(link)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrDuplicateIdentity):
+			v.AddError("identity", "this "+name+" account is already linked to an account")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"identity": link}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"backend/jsonlog"
+	"backend/models"
+	"backend/oauth"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeProvider signs in whoever is in identity, but only for the PKCE
+// verifier it was given when the sign in started
+type fakeProvider struct {
+	verifier string
+	identity oauth.Identity
+}
+
+func (p *fakeProvider) AuthCodeURL(ctx context.Context, state, verifier string) (string, error) {
+	p.verifier = verifier
+	return "https://provider.test/authorize?state=" + url.QueryEscape(state), nil
+}
+
+func (p *fakeProvider) Exchange(ctx context.Context, code, verifier string) (*oauth.Identity, error) {
+	if code != "good-code" || verifier != p.verifier {
+		return nil, oauth.ErrExchange
+	}
+
+	identity := p.identity
+	return &identity, nil
+}
+
+func newOAuthTestApp(db *sql.DB, provider oauthProvider) *application {
+	return &application{
+		logger:         jsonlog.New(io.Discard, jsonlog.LevelInfo),
+		models:         models.NewModels(db),
+		sessions:       newSessionTracker(),
+		oauthProviders: map[string]oauthProvider{"fake": provider},
+	}
+}
+
+func postOAuthCode(t *testing.T, handler http.Handler, path, code, state string, cookies []*http.Cookie, bearer string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	body := fmt.Sprintf(`{"code": %q, "state": %q}`, code, state)
+
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	if bearer != "" {
+		r.Header.Set("Authorization", "Bearer "+bearer)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestValidOAuthState(t *testing.T) {
+	app := newOAuthTestApp(nil, oauthProvider{Provider: &fakeProvider{}})
+
+	tests := []struct {
+		name   string
+		cookie string
+		state  string
+		want   bool
+	}{
+		{"matching", oauthStateHash("abc"), "abc", true},
+		{"other state", oauthStateHash("abc"), "abd", false},
+		{"plain state in cookie", "abc", "abc", false},
+		{"no cookie", "", "abc", false},
+		{"empty state", oauthStateHash(""), "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/v1/oauth/fake/tokens", nil)
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: oauthStateCookie, Value: tt.cookie})
+			}
+
+			if got := app.validOAuthState(r, tt.state); got != tt.want {
+				t.Errorf("validOAuthState = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// A code and state posted from a browser that did not start the sign in is
+// refused before the state is even looked up
+func TestOAuthCallbackRequiresStateCookie(t *testing.T) {
+	app := newOAuthTestApp(nil, oauthProvider{Provider: &fakeProvider{}})
+	handler := app.routes()
+
+	for name, cookies := range map[string][]*http.Cookie{
+		"no cookie":    nil,
+		"other cookie": {{Name: oauthStateCookie, Value: oauthStateHash("someone-elses-state")}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			w := postOAuthCode(t, handler, "/v1/oauth/fake/tokens", "good-code", "the-state", cookies, "")
+
+			if w.Code != http.StatusUnprocessableEntity {
+				t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusUnprocessableEntity, w.Body)
+			}
+			if !strings.Contains(w.Body.String(), "different browser") {
+				t.Errorf("body = %s", w.Body)
+			}
+		})
+	}
+}
+
+// The create and link paths need the real schema. Point TEST_DB_DSN at a
+// migrated database to run them
+func TestOAuthSignInCreatesAndLinks(t *testing.T) {
+	dsn := os.Getenv("TEST_DB_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DB_DSN not set")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	suffix := time.Now().UnixNano()
+	provider := &fakeProvider{}
+	app := newOAuthTestApp(db, oauthProvider{Provider: provider})
+	handler := app.routes()
+
+	// Runs the whole redirect dance and posts the result to path
+	signIn := func(t *testing.T, path, bearer string) *httptest.ResponseRecorder {
+		t.Helper()
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/oauth/fake/authorization", nil))
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("authorization status = %d: %s", w.Code, w.Body)
+		}
+
+		var output struct {
+			State string `json:"state"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&output); err != nil {
+			t.Fatal(err)
+		}
+
+		return postOAuthCode(t, handler, path, "good-code", output.State, w.Result().Cookies(), bearer)
+	}
+
+	t.Run("create", func(t *testing.T) {
+		provider.identity = oauth.Identity{Subject: fmt.Sprintf("new-%d", suffix), Email: fmt.Sprintf("new-%d@example.com", suffix), EmailVerified: true}
+
+		if w := signIn(t, "/v1/oauth/fake/tokens", ""); w.Code != http.StatusCreated {
+			t.Fatalf("status = %d: %s", w.Code, w.Body)
+		}
+
+		user, err := app.models.DB.GetUserForIdentity("fake", provider.identity.Subject)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !user.Activated || user.Email != provider.identity.Email {
+			t.Errorf("user = %+v", user)
+		}
+
+		// Signing in again finds the same account
+		if w := signIn(t, "/v1/oauth/fake/tokens", ""); w.Code != http.StatusCreated {
+			t.Fatalf("second sign in status = %d: %s", w.Code, w.Body)
+		}
+	})
+
+	existing := &models.User{Name: "existing", Email: fmt.Sprintf("existing-%d@example.com", suffix), Activated: true}
+	if err := existing.Password.Set(fmt.Sprintf("correct horse battery %d", suffix)); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.models.DB.InsertWithPermissions(existing); err != nil {
+		t.Fatal(err)
+	}
+
+	provider.identity = oauth.Identity{Subject: fmt.Sprintf("existing-%d", suffix), Email: existing.Email, EmailVerified: true}
+
+	t.Run("existing email is not linked by default", func(t *testing.T) {
+		if w := signIn(t, "/v1/oauth/fake/tokens", ""); w.Code != http.StatusUnprocessableEntity {
+			t.Fatalf("status = %d: %s", w.Code, w.Body)
+		}
+	})
+
+	t.Run("link while signed in", func(t *testing.T) {
+		token, err := app.models.DB.NewToken(existing.ID, time.Hour, models.ScopeAuthentication)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if w := signIn(t, "/v1/users/me/identities/fake", token.Plaintext); w.Code != http.StatusCreated {
+			t.Fatalf("status = %d: %s", w.Code, w.Body)
+		}
+
+		if w := signIn(t, "/v1/oauth/fake/tokens", ""); w.Code != http.StatusCreated {
+			t.Fatalf("sign in after linking status = %d: %s", w.Code, w.Body)
+		}
+
+		user, err := app.models.DB.GetUserForIdentity("fake", provider.identity.Subject)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.ID != existing.ID {
+			t.Errorf("identity linked to user %d, want %d", user.ID, existing.ID)
+		}
+	})
+
+	t.Run("auto link when the provider opts in", func(t *testing.T) {
+		app.oauthProviders["fake"] = oauthProvider{Provider: provider, autoLink: true}
+		provider.identity.Subject = fmt.Sprintf("auto-%d", suffix)
+
+		if w := signIn(t, "/v1/oauth/fake/tokens", ""); w.Code != http.StatusCreated {
+			t.Fatalf("status = %d: %s", w.Code, w.Body)
+		}
+
+		user, err := app.models.DB.GetUserForIdentity("fake", provider.identity.Subject)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.ID != existing.ID {
+			t.Errorf("identity linked to user %d, want %d", user.ID, existing.ID)
+		}
+	})
+}
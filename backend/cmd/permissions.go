@@ -0,0 +1,125 @@
+package main
+
+import (
+	"backend/models"
+	"backend/validator"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Grants users:admin to the account behind email. Every admin route needs
+// that permission, so without this nobody could hand it out in the first place
+func (app *application) bootstrapAdmin(email string) error {
+	user, err := app.models.DB.GetUserByEmail(email)
+	if err != nil {
+		if errors.Is(err, models.ErrRecordNotFound) {
+			return fmt.Errorf("-admin-email: no user registered with %s", email)
+		}
+		return err
+	}
+
+	err = app.models.DB.AddForUser(user.ID, "users:admin")
+	if err != nil {
+		return err
+	}
+
+	app.logger.PrintInfo("granted users:admin", map[string]string{"email": email})
+	return nil
+}
+
+func (app *application) listUserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	permissions, err := app.models.DB.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"permissions": permissions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) grantUserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	app.changeUserPermissions(w, r, app.models.DB.AddForUser)
+}
+
+func (app *application) revokeUserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	app.changeUserPermissions(w, r, app.models.DB.RemoveForUser)
+}
+
+// Grant and revoke only differ in the query they run so they share this
+func (app *application) changeUserPermissions(w http.ResponseWriter, r *http.Request, change func(int64, ...string) error) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Permissions []string `json:"permissions"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	known, err := app.models.DB.GetAllPermissions()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if models.ValidatePermissionCodes(v, input.Permissions, known); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = change(user.ID, input.Permissions...)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	permissions, err := app.models.DB.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"permissions": permissions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Looks up the user named by the :id route param, sending a 404 if there is none
+func (app *application) readUserParam(w http.ResponseWriter, r *http.Request) (*models.User, bool) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	user, err := app.models.DB.GetUser(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return user, true
+}
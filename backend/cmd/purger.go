@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// purgeDeletedUsers runs forever, hard deleting accounts whose deletion
+// grace period has passed
+func (app *application) purgeDeletedUsers() {
+	for {
+		cutoff := time.Now().AddDate(0, 0, -app.config.Deletion.GraceDays)
+
+		purged, err := app.models.DB.PurgeUsersPendingDeletion(cutoff)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		} else if purged > 0 {
+			app.logger.PrintInfo(fmt.Sprintf("purged %d deleted accounts", purged), nil)
+		}
+
+		time.Sleep(time.Hour)
+	}
+}
+
+// purgeLoginAttempts clears failed login counters nobody has touched in a day
+// along with sign in attempts that were never finished
+func (app *application) purgeLoginAttempts() {
+	for {
+		err := app.models.DB.PurgeLoginAttempts(time.Now().Add(-24 * time.Hour))
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+
+		err = app.models.DB.PurgeOAuthStates()
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+
+		time.Sleep(time.Hour)
+	}
+}
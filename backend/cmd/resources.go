@@ -0,0 +1,332 @@
+package main
+
+import (
+	"backend/models"
+	"backend/validator"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// resource is the part of a generic resource the rest of the app needs
+// without knowing its item type
+type resource interface {
+	routes(router *httprouter.Router)
+
+	// name of the section in a user's data export
+	exportName() string
+	export(out io.Writer, ownerID int64) error
+}
+
+// resources lists everything served through the generic handlers. Declare
+// a models.Resource, give Models a repository for it and add it here
+func (app *application) resources() []resource {
+	return []resource{
+		newResourceHandlers(app, app.models.DataLoad),
+	}
+}
+
+// resourceHandlers gives a repository its list, get, create, patch and
+// delete routes. Rows belong to whoever created them, <permission>:admin
+// can see and change everybody's
+type resourceHandlers[T any] struct {
+	app  *application
+	repo *models.Repository[T]
+
+	// Ignore unknown body keys, for routes older clients still call
+	lenient bool
+}
+
+func newResourceHandlers[T any](app *application, repo *models.Repository[T]) *resourceHandlers[T] {
+	return &resourceHandlers[T]{app: app, repo: repo}
+}
+
+func (h *resourceHandlers[T]) permission(action string) string {
+	return h.repo.Resource.Permission + ":" + action
+}
+
+func (h *resourceHandlers[T]) routes(router *httprouter.Router) {
+	app := h.app
+	path := "/v1/" + h.repo.Resource.Name
+
+	router.HandlerFunc(http.MethodGet, path, app.requirePermission(h.permission("read"), h.listHandler))
+	router.HandlerFunc(http.MethodGet, path+"/:id", app.requirePermission(h.permission("read"), h.showHandler))
+	router.HandlerFunc(http.MethodPost, path, app.requirePermission(h.permission("write"), h.createHandler))
+	router.HandlerFunc(http.MethodPatch, path+"/:id", app.requirePermission(h.permission("write"), h.updateHandler))
+	router.HandlerFunc(http.MethodDelete, path+"/:id", app.requirePermission(h.permission("write"), h.deleteHandler))
+}
+
+func (h *resourceHandlers[T]) isAdmin(r *http.Request) (bool, error) {
+	permissions, err := h.app.requestPermissions(r)
+	if err != nil {
+		return false, err
+	}
+
+	return permissions.Include(h.permission("admin")), nil
+}
+
+// Fetches a row the caller may touch. Rows owned by someone else look like
+// they do not exist unless the caller is an admin for the resource
+func (h *resourceHandlers[T]) readOwned(w http.ResponseWriter, r *http.Request) (*T, bool) {
+	app := h.app
+
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	item, err := h.repo.Get(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	if h.repo.Record(item).OwnerID == app.contextGetUser(r).ID {
+		return item, true
+	}
+
+	isAdmin, err := h.isAdmin(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return nil, false
+	}
+
+	if !isAdmin {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	return item, true
+}
+
+// Reads the body onto item, only touching the resource's editable columns
+func (h *resourceHandlers[T]) readInput(w http.ResponseWriter, r *http.Request, item *T) bool {
+	var input map[string]json.RawMessage
+
+	err := h.app.readJSON(w, r, &input)
+	if err == nil {
+		if h.lenient {
+			err = h.repo.PatchLenient(item, input)
+		} else {
+			err = h.repo.Patch(item, input)
+		}
+	}
+
+	if err != nil {
+		h.app.badRequestResponse(w, r, err)
+		return false
+	}
+
+	return true
+}
+
+func (h *resourceHandlers[T]) validate(w http.ResponseWriter, r *http.Request, item *T) bool {
+	v := validator.New()
+
+	if h.repo.Resource.Validate(v, item); !v.Valid() {
+		h.app.failedValidationResponse(w, r, v.Errors)
+		return false
+	}
+
+	return true
+}
+
+func (h *resourceHandlers[T]) listHandler(w http.ResponseWriter, r *http.Request) {
+	app := h.app
+	res := h.repo.Resource
+
+	var input struct {
+		Search string
+		Owner  string
+		models.Filters
+	}
+
+	v := validator.New()
+	qs := r.URL.Query()
+
+	if res.SearchColumn != "" {
+		input.Search = app.readString(qs, res.SearchColumn, "")
+	}
+
+	input.Owner = app.readString(qs, "owner", "me")
+	v.Check(validator.In(input.Owner, "me", "all"), "owner", "must be either me or all")
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+
+	input.Filters.Sort = app.readString(qs, "sort", "id")
+	input.Filters.SortSafeList = h.repo.SortSafeList()
+
+	if models.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Callers only see their own rows unless an admin asks for everything
+	ownerID := app.contextGetUser(r).ID
+	if input.Owner == "all" {
+		isAdmin, err := h.isAdmin(r)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if !isAdmin {
+			app.notPermittedResponse(w, r)
+			return
+		}
+		ownerID = 0
+	}
+
+	items, metadata, err := h.repo.GetAll(input.Search, ownerID, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{res.ListKey: items, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (h *resourceHandlers[T]) showHandler(w http.ResponseWriter, r *http.Request) {
+	item, ok := h.readOwned(w, r)
+	if !ok {
+		return
+	}
+
+	err := h.app.writeJSON(w, http.StatusOK, envelope{h.repo.Resource.Key: item}, nil)
+	if err != nil {
+		h.app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (h *resourceHandlers[T]) createHandler(w http.ResponseWriter, r *http.Request) {
+	app := h.app
+
+	item := new(T)
+	h.repo.Record(item).OwnerID = app.contextGetUser(r).ID
+
+	if !h.readInput(w, r, item) || !h.validate(w, r, item) {
+		return
+	}
+
+	err := h.repo.Insert(item)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{h.repo.Resource.Key: item}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (h *resourceHandlers[T]) updateHandler(w http.ResponseWriter, r *http.Request) {
+	app := h.app
+
+	// This is where we pull all the data first to update
+	item, ok := h.readOwned(w, r)
+	if !ok {
+		return
+	}
+
+	if !h.readInput(w, r, item) || !h.validate(w, r, item) {
+		return
+	}
+
+	err := h.repo.Update(item)
+	if err != nil {
+		switch {
+		// the race condition editing error message
+		case errors.Is(err, models.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{h.repo.Resource.Key: item}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (h *resourceHandlers[T]) deleteHandler(w http.ResponseWriter, r *http.Request) {
+	app := h.app
+
+	item, ok := h.readOwned(w, r)
+	if !ok {
+		return
+	}
+
+	err := h.repo.Delete(h.repo.Record(item).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	message := h.repo.Resource.DeleteMessage
+	if message == "" {
+		message = fmt.Sprintf("%s deleted successfully", h.repo.Resource.Key)
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": message}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (h *resourceHandlers[T]) exportName() string {
+	return h.repo.Resource.Table
+}
+
+// Writes the owner's rows as a JSON array one row at a time
+func (h *resourceHandlers[T]) export(out io.Writer, ownerID int64) error {
+	if _, err := io.WriteString(out, "["); err != nil {
+		return err
+	}
+
+	first := true
+
+	err := h.repo.EachForOwner(ownerID, func(item *T) error {
+		if !first {
+			if _, err := io.WriteString(out, ","); err != nil {
+				return err
+			}
+		}
+		first = false
+
+		js, err := json.Marshal(item)
+		if err != nil {
+			return err
+		}
+
+		_, err = out.Write(js)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(out, "]\n")
+	return err
+}
@@ -5,6 +5,18 @@ import (
   "github.com/julienschmidt/httprouter"
 )
 
+// httprouter will not register /v1/users/me next to /v1/users/:id, so the
+// "me" routes live under :id and get picked out here
+func (app *application) meOr(me, other http.HandlerFunc) http.HandlerFunc {
+  return func(w http.ResponseWriter, r *http.Request) {
+    if httprouter.ParamsFromContext(r.Context()).ByName("id") == "me" {
+      me(w, r)
+      return
+    }
+    other(w, r)
+  }
+}
+
 func (app *application) routes() http.Handler {
   router := httprouter.New()
     //Add our custom error handling 
@@ -15,15 +27,62 @@ func (app *application) routes() http.Handler {
 
   router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
   router.HandlerFunc(http.MethodGet, "/v1/status", app.statusHandler)
-  router.HandlerFunc(http.MethodGet, "/v1/data/:id", app.requireActivatedUser(app.getData))
-  router.HandlerFunc(http.MethodGet, "/v1/data", app.requireActivatedUser(app.listAllDBData))
   router.HandlerFunc(http.MethodPost, "/v1/register", app.registerUser)
-  //router.HandlerFunc(http.MethodPost, "/v1/login/", app.login)
-  router.HandlerFunc(http.MethodPost, "/v1/post_data/", app.requireActivatedUser(app.insertPayload))
-  router.HandlerFunc(http.MethodPatch, "/v1/data/:id", app.requireActivatedUser(app.updateDBData))
-  router.HandlerFunc(http.MethodDelete, "/v1/data/:id", app.requireActivatedUser(app.deleteDBload))
+
+  // list/get/create/patch/delete for every generic resource, e.g. /v1/data
+  for _, res := range app.resources() {
+    res.routes(router)
+  }
+
+  // Older clients still create dataload rows here, with the loose decoding
+  // they were written against
+  dataload := newResourceHandlers(app, app.models.DataLoad)
+  dataload.lenient = true
+  router.HandlerFunc(http.MethodPost, "/v1/post_data/", app.requirePermission(dataload.permission("write"), dataload.createHandler))
+
   router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUser)
+  router.HandlerFunc(http.MethodPut, "/v1/users/password", app.updateUserPassword)
+  router.HandlerFunc(http.MethodPut, "/v1/users/me/password", app.requireInteractiveSession(app.changeCurrentUserPasswordHandler))
+  router.HandlerFunc(http.MethodGet, "/v1/users", app.requirePermission("users:admin", app.listUsersHandler))
+  router.HandlerFunc(http.MethodGet, "/v1/users/:id", app.meOr(app.requireAuthenticatedUser(app.showCurrentUserHandler), app.requirePermission("users:admin", app.showUserHandler)))
+  router.HandlerFunc(http.MethodPatch, "/v1/users/:id", app.meOr(app.requireInteractiveSession(app.updateCurrentUserHandler), app.requirePermission("users:admin", app.updateUserHandler)))
+  router.HandlerFunc(http.MethodDelete, "/v1/users/:id", app.meOr(app.requireInteractiveSession(app.deleteCurrentUserHandler), app.notFoundResponse))
+  router.HandlerFunc(http.MethodPut, "/v1/users/deletion-cancelled", app.cancelUserDeletionHandler)
+  router.HandlerFunc(http.MethodPost, "/v1/users/:id/totp", app.meOr(app.requireInteractiveSession(app.enrollTOTPHandler), app.notFoundResponse))
+  router.HandlerFunc(http.MethodPut, "/v1/users/me/totp", app.requireInteractiveSession(app.confirmTOTPHandler))
+  router.HandlerFunc(http.MethodDelete, "/v1/users/:id/totp", app.meOr(app.requireInteractiveSession(app.disableTOTPHandler), app.notFoundResponse))
+  router.HandlerFunc(http.MethodGet, "/v1/users/:id/api-keys", app.meOr(app.requireActivatedUser(app.requireInteractiveSession(app.listAPIKeysHandler)), app.notFoundResponse))
+  router.HandlerFunc(http.MethodPost, "/v1/users/:id/api-keys", app.meOr(app.requireActivatedUser(app.requireInteractiveSession(app.createAPIKeyHandler)), app.notFoundResponse))
+  router.HandlerFunc(http.MethodDelete, "/v1/users/:id/api-keys/:key_id", app.meOr(app.requireActivatedUser(app.requireInteractiveSession(app.deleteAPIKeyHandler)), app.notFoundResponse))
+  router.HandlerFunc(http.MethodGet, "/v1/users/:id/sessions", app.meOr(app.requireInteractiveSession(app.listSessionsHandler), app.notFoundResponse))
+  router.HandlerFunc(http.MethodDelete, "/v1/users/:id/sessions/:session_id", app.meOr(app.requireInteractiveSession(app.deleteSessionHandler), app.notFoundResponse))
+  router.HandlerFunc(http.MethodPost, "/v1/users/:id/identities/:provider", app.meOr(app.requireActivatedUser(app.requireInteractiveSession(app.createIdentityHandler)), app.notFoundResponse))
+  router.HandlerFunc(http.MethodGet, "/v1/users/:id/export", app.meOr(app.requireInteractiveSession(app.exportCurrentUserHandler), app.notFoundResponse))
+  router.HandlerFunc(http.MethodGet, "/v1/users/:id/permissions", app.requirePermission("users:admin", app.listUserPermissionsHandler))
+  router.HandlerFunc(http.MethodPost, "/v1/users/:id/permissions", app.requirePermission("users:admin", app.grantUserPermissionsHandler))
+  router.HandlerFunc(http.MethodDelete, "/v1/users/:id/permissions", app.requirePermission("users:admin", app.revokeUserPermissionsHandler))
+  router.HandlerFunc(http.MethodPost, "/v1/users/:id/suspension", app.requirePermission("users:admin", app.suspendUserHandler))
+  router.HandlerFunc(http.MethodDelete, "/v1/users/:id/suspension", app.requirePermission("users:admin", app.unsuspendUserHandler))
+  router.HandlerFunc(http.MethodGet, "/v1/users/:id/roles", app.requirePermission("users:admin", app.listUserRolesHandler))
+  router.HandlerFunc(http.MethodPost, "/v1/users/:id/roles", app.requirePermission("users:admin", app.assignUserRolesHandler))
+  router.HandlerFunc(http.MethodDelete, "/v1/users/:id/roles", app.requirePermission("users:admin", app.unassignUserRolesHandler))
+  router.HandlerFunc(http.MethodGet, "/v1/roles", app.requirePermission("users:admin", app.listRolesHandler))
+  router.HandlerFunc(http.MethodPost, "/v1/roles", app.requirePermission("users:admin", app.createRoleHandler))
+  router.HandlerFunc(http.MethodPatch, "/v1/roles/:id", app.requirePermission("users:admin", app.updateRoleHandler))
+  router.HandlerFunc(http.MethodDelete, "/v1/roles/:id", app.requirePermission("users:admin", app.deleteRoleHandler))
+  router.HandlerFunc(http.MethodGet, "/v1/oauth/:provider/authorization", app.createOAuthAuthorizationHandler)
+  router.HandlerFunc(http.MethodPost, "/v1/oauth/:provider/tokens", app.createOAuthAuthenticationTokenHandler)
+
   router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
+  router.HandlerFunc(http.MethodPost, "/v1/tokens/jwt", app.createJWTAuthenticationTokenHandler)
+  router.HandlerFunc(http.MethodPost, "/v1/tokens/mfa", app.createMFAAuthenticationTokenHandler)
+  router.HandlerFunc(http.MethodPost, "/v1/tokens/refresh", app.refreshAuthenticationTokenHandler)
+  router.HandlerFunc(http.MethodPost, "/v1/tokens/magic-link", app.createMagicLinkTokenHandler)
+  router.HandlerFunc(http.MethodPost, "/v1/tokens/magic-link/exchange", app.exchangeMagicLinkTokenHandler)
+  router.HandlerFunc(http.MethodPost, "/v1/tokens/password-reset", app.createPasswordResetTokenHandler)
+  router.HandlerFunc(http.MethodPost, "/v1/tokens/activation", app.createActivationTokenHandler)
+  router.HandlerFunc(http.MethodDelete, "/v1/tokens/authentication", app.requireInteractiveSession(app.deleteAuthenticationTokenHandler))
+  router.HandlerFunc(http.MethodDelete, "/v1/tokens/authentication/all", app.requireInteractiveSession(app.deleteAllAuthenticationTokensHandler))
 
   return app.recoverPanic(app.rateLimit(app.enableCORS(app.authenticate(router))))
 }
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"backend/models"
+	"crypto/sha256"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// sessionTracker collects last used times in memory so authenticate does not
+// have to write to the tokens table on every request. Tokens are kept by hash,
+// like in the database, so live plaintexts never sit around in memory
+type sessionTracker struct {
+	mu       sync.Mutex
+	lastUsed map[[sha256.Size]byte]time.Time
+}
+
+func newSessionTracker() *sessionTracker {
+	return &sessionTracker{lastUsed: make(map[[sha256.Size]byte]time.Time)}
+}
+
+func (t *sessionTracker) Touch(token string) {
+	hash := sha256.Sum256([]byte(token))
+
+	t.mu.Lock()
+	t.lastUsed[hash] = time.Now()
+	t.mu.Unlock()
+}
+
+// Hands back everything collected so far and starts a fresh batch
+func (t *sessionTracker) drain() map[[sha256.Size]byte]time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	batch := t.lastUsed
+	t.lastUsed = make(map[[sha256.Size]byte]time.Time)
+	return batch
+}
+
+// flushSessions runs forever, writing the batched last used times once a minute
+func (app *application) flushSessions() {
+	for {
+		time.Sleep(time.Minute)
+
+		batch := app.sessions.drain()
+		if len(batch) == 0 {
+			continue
+		}
+
+		err := app.models.DB.TouchTokens(batch)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	}
+}
+
+// Describes the client making the request for the session listing
+func (app *application) clientFromRequest(r *http.Request) models.Client {
+	client := models.Client{UserAgent: r.UserAgent()}
+
+	if len(client.UserAgent) > 512 {
+		client.UserAgent = client.UserAgent[:512]
+	}
+
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		client.IP = ip
+	}
+
+	return client
+}
+
+func (app *application) listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	token, _ := app.readSessionToken(r)
+
+	sessions, err := app.models.DB.GetSessionsForUser(user.ID, token)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"sessions": sessions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteSessionHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	id, err := strconv.ParseInt(httprouter.ParamsFromContext(r.Context()).ByName("session_id"), 10, 64)
+	if err != nil || id < 1 {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.DB.DeleteSessionForUser(id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "session revoked successfully"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// throttle allows one action per key every interval, e.g. one email per address
+type throttle struct {
+	mu       sync.Mutex
+	interval time.Duration
+	lastSeen map[string]time.Time
+}
+
+func newThrottle(interval time.Duration) *throttle {
+	t := &throttle{
+		interval: interval,
+		lastSeen: make(map[string]time.Time),
+	}
+
+	// Clear out keys that are allowed again so the map does not grow forever
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+			t.mu.Lock()
+
+			for key, seen := range t.lastSeen {
+				if time.Since(seen) > t.interval {
+					delete(t.lastSeen, key)
+				}
+			}
+			t.mu.Unlock()
+		}
+	}()
+
+	return t
+}
+
+// Allow reports whether the key may act now and records it if so
+func (t *throttle) Allow(key string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if seen, found := t.lastSeen[key]; found && time.Since(seen) < t.interval {
+		return false
+	}
+
+	t.lastSeen[key] = time.Now()
+	return true
+}
@@ -4,11 +4,505 @@ import (
 	"backend/models"
 	"backend/validator"
 	"errors"
+	"github.com/pascaldekloe/jwt"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// These identify our tokens to the edge services validating them
+const (
+	jwtIssuer   = "github.com/melkeydev"
+	jwtAudience = "github.com/melkeydev"
+)
+
+// How long a refresh token can sit unused before the session is gone
+const refreshTokenTTL = 30 * 24 * time.Hour
+
 func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.checkCredentials(w, r)
+	if !ok {
+		return
+	}
+
+	app.completeLogin(w, r, user)
+}
+
+// Issues session tokens for a user who has proven who they are, unless 2FA
+// still stands in the way
+func (app *application) completeLogin(w http.ResponseWriter, r *http.Request, user *models.User) {
+	hasTOTP, err := app.userHasTOTP(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// With 2FA on, signing in only buys a short lived token for POST /v1/tokens/mfa
+	if hasTOTP {
+		token, err := app.models.DB.NewToken(user.ID, 5*time.Minute, models.ScopeMFAPending)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = app.writeJSON(w, http.StatusAccepted, envelope{"mfa_required": true, "mfa_token": token}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.issueSessionTokens(w, r, user.ID)
+}
+
+// Creates a new token family with an auth and a refresh token and sends them
+func (app *application) issueSessionTokens(w http.ResponseWriter, r *http.Request, userID int64) {
+	// Every login starts a new family for its auth and refresh tokens
+	family, err := models.NewTokenFamily()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Creates a new auth token and saves it
+	client := app.clientFromRequest(r)
+
+	token, err := app.models.DB.NewTokenInFamily(userID, 24*time.Hour, models.ScopeAuthentication, family, client)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	refreshToken, err := app.models.DB.NewTokenInFamily(userID, refreshTokenTTL, models.ScopeRefresh, family, client)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.writeSessionTokens(w, r, token, refreshToken)
+}
+
+// Sends the tokens in the body, or as cookies when the client asked for them
+func (app *application) writeSessionTokens(w http.ResponseWriter, r *http.Request, token, refreshToken *models.Token) {
+	data := envelope{"authentication_token": token, "refresh_token": refreshToken}
+
+	if app.wantsSessionCookies(r) {
+		csrfToken, err := app.setSessionCookies(w, token, refreshToken)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		data = envelope{"authentication_token": envelope{"expiry": token.Expiry}, "csrf_token": csrfToken}
+	}
+
+	err := app.writeJSON(w, http.StatusCreated, data, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Exchanges a refresh token for a new auth token and the next refresh token
+func (app *application) refreshAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	// In cookie mode the refresh token comes in its own cookie and no body is needed
+	input.RefreshToken = app.readCookie(r, refreshCookie)
+
+	if input.RefreshToken != "" {
+		if !app.validCSRF(r) {
+			app.invalidCSRFTokenResponse(w, r)
+			return
+		}
+	} else {
+		err := app.readJSON(w, r, &input)
+		if err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
+	}
+
+	v := validator.New()
+
+	if models.ValidateTokenPlaintext(v, input.RefreshToken); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	client := app.clientFromRequest(r)
+
+	refreshToken, err := app.models.DB.RotateRefreshToken(input.RefreshToken, refreshTokenTTL, client)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrTokenReused):
+			app.logError(r, err)
+			app.invalidAuthenticationTokenResponse(w, r)
+		case errors.Is(err, models.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	token, err := app.models.DB.NewTokenInFamily(refreshToken.UserID, 24*time.Hour, models.ScopeAuthentication, refreshToken.Family, client)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.writeSessionTokens(w, r, token, refreshToken)
+}
+
+// Same as above but hands back a signed JWT instead of storing a token
+func (app *application) createJWTAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.checkCredentials(w, r)
+	if !ok {
+		return
+	}
+
+	hasTOTP, err := app.userHasTOTP(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if hasTOTP {
+		app.mfaRequiredResponse(w, r)
+		return
+	}
+
+	token, expiry, err := app.signJWT(user, 24*time.Hour)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": envelope{"token": string(token), "expiry": expiry}}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Logs out the session behind the bearer token or cookie used on this request
+func (app *application) deleteAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	token, _ := app.readSessionToken(r)
+
+	v := validator.New()
+
+	var err error
+
+	// JWTs are stateless, the only way to revoke one is to revoke all of the user's
+	if models.ValidateTokenPlaintext(v, token); v.Valid() {
+		err = app.models.DB.DeleteToken(models.ScopeAuthentication, token)
+	} else {
+		err = app.models.DB.RevokeJWTs(app.contextGetUser(r).ID)
+	}
+
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if app.readCookie(r, sessionCookie) != "" {
+		app.clearSessionCookies(w)
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "logged out successfully"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Signs the user out everywhere by dropping all of their session tokens
+func (app *application) deleteAllAuthenticationTokensHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	for _, scope := range []string{models.ScopeAuthentication, models.ScopeRefresh} {
+		err := app.models.DB.DeleteAlForUser(scope, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err := app.models.DB.RevokeJWTs(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if app.readCookie(r, sessionCookie) != "" {
+		app.clearSessionCookies(w)
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "logged out of all sessions successfully"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Emails a one time token that can be exchanged for a new password
+func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if models.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Same answer whether or not the account exists, so this can not be used
+	// to find out who has one
+	message := envelope{"message": "if an activated account uses this email, it will be sent password reset instructions"}
+
+	user, err := app.models.DB.GetUserByEmail(input.Email)
+	if err != nil && !errors.Is(err, models.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if err != nil || !user.Activated {
+		err = app.writeJSON(w, http.StatusAccepted, message, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	token, err := app.models.DB.NewToken(user.ID, 45*time.Minute, models.ScopePasswordReset)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.background(func() {
+		data := map[string]interface{}{
+			"passwordResetToken": token.Plaintext,
+		}
+
+		err := app.mailer.Send(user.Email, "token_password_reset.tmpl", data)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	})
+
+	err = app.writeJSON(w, http.StatusAccepted, message, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Sends a fresh activation email for accounts whose first one got lost or expired
+func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if models.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Only one activation email per address every few minutes
+	if !app.activationThrottle.Allow(strings.ToLower(input.Email)) {
+		app.rateLimitExceededResponse(w, r)
+		return
+	}
+
+	// Unknown and already activated addresses get the same answer as real
+	// ones so nobody can probe which accounts exist
+	message := envelope{"message": "if this email belongs to an account waiting for activation, it will be sent activation instructions"}
+
+	user, err := app.models.DB.GetUserByEmail(input.Email)
+	if err != nil && !errors.Is(err, models.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if err != nil || user.Activated {
+		err = app.writeJSON(w, http.StatusAccepted, message, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Older activation tokens should stop working once a new one is sent
+	err = app.models.DB.DeleteAlForUser(models.ScopeActivation, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	token, err := app.models.DB.NewToken(user.ID, 3*24*time.Hour, models.ScopeActivation)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.background(func() {
+		data := map[string]interface{}{
+			"activationToken": token.Plaintext,
+			"userID":          user.ID,
+		}
+
+		err := app.mailer.Send(user.Email, "user_welcome.tmpl", data)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	})
+
+	err = app.writeJSON(w, http.StatusAccepted, message, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Emails a single use link that signs the user in without their password.
+// The answer is the same whether or not the address has an account
+func (app *application) createMagicLinkTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if models.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if !app.magicLinkThrottle.Allow(strings.ToLower(input.Email)) {
+		app.rateLimitExceededResponse(w, r)
+		return
+	}
+
+	message := envelope{"message": "if an activated account uses this email, a sign in link is on its way"}
+
+	user, err := app.models.DB.GetUserByEmail(input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrRecordNotFound):
+			err = app.writeJSON(w, http.StatusAccepted, message, nil)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+			}
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if user.Activated {
+		token, err := app.models.DB.NewToken(user.ID, 15*time.Minute, models.ScopeMagicLink)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		app.background(func() {
+			data := map[string]interface{}{
+				"magicLinkToken": token.Plaintext,
+			}
+
+			err := app.mailer.Send(user.Email, "token_magic_link.tmpl", data)
+			if err != nil {
+				app.logger.PrintError(err, nil)
+			}
+		})
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, message, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Swaps a magic link token for a normal session. The token is deleted before
+// anything is issued so a link can only ever be used once
+func (app *application) exchangeMagicLinkTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Token string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if models.ValidateTokenPlaintext(v, input.Token); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.DB.GetForToken(models.ScopeMagicLink, input.Token)
+	if err == nil {
+		// Losing this race to a parallel request means the link is already spent
+		err = app.models.DB.DeleteToken(models.ScopeMagicLink, input.Token)
+	}
+
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired sign in link")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if user.IsPendingDeletion() {
+		app.accountPendingDeletionResponse(w, r)
+		return
+	}
+
+	if user.IsSuspended() {
+		app.accountSuspendedResponse(w, r, user)
+		return
+	}
+
+	app.completeLogin(w, r, user)
+}
+
+// checkCredentials reads the email and password from the body and matches
+// them against the stored user. If it returns false a response has been sent
+func (app *application) checkCredentials(w http.ResponseWriter, r *http.Request) (*models.User, bool) {
 	var input struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
@@ -18,68 +512,144 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 
 	if err != nil {
 		app.badRequestResponse(w, r, err)
-		return
+		return nil, false
 	}
 
 	// Validate the email and password
 	v := validator.New()
-	
+
 	models.ValidateEmail(v, input.Email)
 	models.ValidatePasswordPlaintext(v, input.Password)
 
 	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
-		return
+		return nil, false
+	}
+
+	// Back off before we even look at the password
+	emailKey, ipKey := loginKeys(r, input.Email)
+
+	retryAfter, err := app.loginRetryAfter(emailKey, ipKey)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return nil, false
+	}
+
+	if retryAfter > 0 {
+		app.tooManyLoginAttemptsResponse(w, r, retryAfter)
+		return nil, false
 	}
 
 	user, err := app.models.DB.GetUserByEmail(input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, models.ErrRecordNotFound):
+			if err := app.recordLoginFailure(emailKey, ipKey, nil); err != nil {
+				app.serverErrorResponse(w, r, err)
+				return nil, false
+			}
 			app.invalidCredentialResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
-		return
+		return nil, false
 	}
-	
+
 	// Compare and match the hash passwords
 	match, err := user.Password.Matches(input.Password)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
-		return
+		return nil, false
 	}
 
 	// if passwords do not match
 	if !match {
+		if err := app.recordLoginFailure(emailKey, ipKey, user); err != nil {
+			app.serverErrorResponse(w, r, err)
+			return nil, false
+		}
 		app.invalidCredentialResponse(w, r)
-		return
+		return nil, false
 	}
 
-	// Creates a new auth token and saves it
-	token, err := app.models.DB.NewToken(user.ID, 24*time.Hour, models.ScopeAuthentication) 
+	err = app.clearLoginFailures(emailKey, ipKey)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
-		return
+		return nil, false
 	}
 
-	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token":token}, nil)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
+	if user.IsPendingDeletion() {
+		app.accountPendingDeletionResponse(w, r)
+		return nil, false
 	}
-}
-
-
 
+	if user.IsSuspended() {
+		app.accountSuspendedResponse(w, r, user)
+		return nil, false
+	}
 
+	// Move old bcrypt hashes or outdated costs onto the current hasher while
+	// we still have the plaintext. A failure here should not block the login,
+	// and a password too long for the current hasher keeps the hash it has
+	if user.Password.NeedsRehash() && len(input.Password) <= models.PasswordHasher.MaxLength() {
+		err = app.models.DB.RehashPassword(user, input.Password)
+		if err != nil {
+			app.logError(r, err)
+		}
+	}
 
+	return user, true
+}
 
+// signJWT creates HS256 claims for the user signed with our configured secret.
+// The user's token version goes in too so the JWT can be revoked later
+func (app *application) signJWT(user *models.User, ttl time.Duration) ([]byte, time.Time, error) {
+	now := time.Now()
+	expiry := now.Add(ttl)
 
+	var claims jwt.Claims
+	claims.Subject = strconv.FormatInt(user.ID, 10)
+	claims.Issued = jwt.NewNumericTime(now)
+	claims.NotBefore = jwt.NewNumericTime(now)
+	claims.Expires = jwt.NewNumericTime(expiry)
+	claims.Issuer = jwtIssuer
+	claims.Audiences = []string{jwtAudience}
+	claims.Set = map[string]interface{}{"ver": user.TokenVersion}
 
+	token, err := claims.HMACSign(jwt.HS256, []byte(app.config.Jwt.Secret))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
 
+	return token, expiry, nil
+}
 
+// verifyJWT checks the signature and the registered claims and returns the
+// user ID and the token version the JWT was issued with
+func (app *application) verifyJWT(token string) (int64, int, error) {
+	claims, err := jwt.HMACCheck([]byte(token), []byte(app.config.Jwt.Secret))
+	if err != nil {
+		return 0, 0, err
+	}
 
+	if !claims.Valid(time.Now()) {
+		return 0, 0, errors.New("jwt is expired or not yet valid")
+	}
 
+	if claims.Issuer != jwtIssuer || !claims.AcceptAudience(jwtAudience) {
+		return 0, 0, errors.New("jwt has an unexpected issuer or audience")
+	}
 
+	userID, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil {
+		return 0, 0, errors.New("jwt has an invalid subject")
+	}
 
+	// JSON numbers come back as float64
+	version, ok := claims.Set["ver"].(float64)
+	if !ok {
+		return 0, 0, errors.New("jwt has no token version")
+	}
 
+	return userID, int(version), nil
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"backend/models"
+	"backend/totp"
+	"backend/validator"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const totpIssuer = "Go-React-Boiler"
+
+func (app *application) userHasTOTP(userID int64) (bool, error) {
+	t, err := app.models.DB.GetTOTP(userID)
+	if err != nil {
+		if errors.Is(err, models.ErrRecordNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return t.Enabled, nil
+}
+
+// Checks a code from the user's authenticator app and burns its time step
+func (app *application) verifyTOTPCode(userID int64, code string) (bool, error) {
+	t, err := app.models.DB.GetTOTP(userID)
+	if err != nil {
+		if errors.Is(err, models.ErrRecordNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	step, ok := totp.Validate(t.Secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+
+	err = app.models.DB.UseTOTPStep(userID, step)
+	if err != nil {
+		if errors.Is(err, models.ErrEditConflict) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Checks an authenticator code, or else uses up a recovery code
+func (app *application) verifyMFACode(userID int64, code, recoveryCode string) (bool, error) {
+	if code != "" {
+		return app.verifyTOTPCode(userID, code)
+	}
+
+	err := app.models.DB.UseRecoveryCode(userID, recoveryCode)
+	if errors.Is(err, models.ErrRecordNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Runs a code check behind the same backoff and lockout as password logins,
+// so every endpoint taking a code is as hard to brute force as the MFA step.
+// It writes the response and returns false unless the code was accepted
+func (app *application) checkMFAAttempt(w http.ResponseWriter, r *http.Request, user *models.User, verify func() (bool, error), invalid func()) bool {
+	mfaKey := fmt.Sprintf("mfa:%d", user.ID)
+	_, ipKey := loginKeys(r, user.Email)
+
+	retryAfter, err := app.loginRetryAfter(mfaKey, ipKey)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	if retryAfter > 0 {
+		app.tooManyLoginAttemptsResponse(w, r, retryAfter)
+		return false
+	}
+
+	ok, err := verify()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	if !ok {
+		if err := app.recordLoginFailure(mfaKey, ipKey, user); err != nil {
+			app.serverErrorResponse(w, r, err)
+			return false
+		}
+		invalid()
+		return false
+	}
+
+	err = app.clearLoginFailures(mfaKey, ipKey)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	return true
+}
+
+// Starts enrollment by handing out a secret. 2FA stays off until confirmed
+func (app *application) enrollTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	hasTOTP, err := app.userHasTOTP(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if hasTOTP {
+		v := validator.New()
+		v.AddError("totp", "two-factor authentication is already enabled")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.DB.SetTOTPSecret(user.ID, secret)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"secret": secret, "uri": totp.URI(secret, totpIssuer, user.Email)}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Turns 2FA on once the user proves their app works and returns the recovery codes
+func (app *application) confirmTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var input struct {
+		Code string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	t, err := app.models.DB.GetTOTP(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrRecordNotFound):
+			v.AddError("totp", "enroll with POST /v1/users/me/totp first")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if t.Enabled {
+		v.AddError("totp", "two-factor authentication is already enabled")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	verify := func() (bool, error) { return app.verifyTOTPCode(user.ID, input.Code) }
+	invalid := func() {
+		v.AddError("code", "invalid code")
+		app.failedValidationResponse(w, r, v.Errors)
+	}
+
+	if !app.checkMFAAttempt(w, r, user, verify, invalid) {
+		return
+	}
+
+	err = app.models.DB.EnableTOTP(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	codes, err := app.models.DB.NewRecoveryCodes(user.ID, 10)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"recovery_codes": codes}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) disableTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var input struct {
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(input.Code != "" || input.RecoveryCode != "", "code", "a code or a recovery code must be provided")
+	v.Check(input.Code == "" || input.RecoveryCode == "", "code", "provide either a code or a recovery code, not both")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Someone who lost their authenticator can still get out with a recovery code
+	verify := func() (bool, error) { return app.verifyMFACode(user.ID, input.Code, input.RecoveryCode) }
+	invalid := func() {
+		v.AddError("code", "invalid code")
+		app.failedValidationResponse(w, r, v.Errors)
+	}
+
+	if !app.checkMFAAttempt(w, r, user, verify, invalid) {
+		return
+	}
+
+	err = app.models.DB.DeleteTOTP(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "two-factor authentication disabled"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Second login step: swaps an MFA pending token plus a code for real tokens
+func (app *application) createMFAAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		MFAToken     string `json:"mfa_token"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	models.ValidateTokenPlaintext(v, input.MFAToken)
+	v.Check(input.Code != "" || input.RecoveryCode != "", "code", "a code or a recovery code must be provided")
+	v.Check(input.Code == "" || input.RecoveryCode == "", "code", "provide either a code or a recovery code, not both")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.DB.GetForToken(models.ScopeMFAPending, input.MFAToken)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Guessing codes goes through the same backoff and lockout as passwords
+	verify := func() (bool, error) { return app.verifyMFACode(user.ID, input.Code, input.RecoveryCode) }
+
+	if !app.checkMFAAttempt(w, r, user, verify, func() { app.invalidCredentialResponse(w, r) }) {
+		return
+	}
+
+	err = app.models.DB.DeleteAlForUser(models.ScopeMFAPending, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.issueSessionTokens(w, r, user.ID)
+}
@@ -93,7 +93,7 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst int
 
     case errors.As(err, &unmarshallTypeError):
       if unmarshallTypeError.Field != "" {
-        return fmt.Errorf("body contains incorrect JSON type for field %d", unmarshallTypeError.Field)
+        return fmt.Errorf("body contains incorrect JSON type for field %q", unmarshallTypeError.Field)
       }
       return fmt.Errorf("Body contains incorrect JSON")
 
@@ -160,30 +160,32 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
   return i
 }
 
+// Returns nil when the key is missing so callers can tell "not set" from false
+func (app *application) readBool(qs url.Values, key string, v *validator.Validator) *bool {
+  s := qs.Get(key)
 
+  if s == "" {
+    return nil
+  }
 
+  b, err := strconv.ParseBool(s)
+  if err != nil {
+    v.AddError(key, "must be a boolean value")
+    return nil
+  }
 
+  return &b
+}
 
+// Runs fn in a goroutine and logs any panic instead of taking the server down
+func (app *application) background(fn func()) {
+  go func() {
+    defer func() {
+      if err := recover(); err != nil {
+        app.logger.PrintError(fmt.Errorf("%s", err), nil)
+      }
+    }()
 
-
-
-
-
-
-
-
-
-
-
-
-
-
-
-
-
-
-
-
-
-
-
+    fn()
+  }()
+}
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS tokens_family_idx;
+
+ALTER TABLE tokens DROP COLUMN IF EXISTS used;
+ALTER TABLE tokens DROP COLUMN IF EXISTS family;
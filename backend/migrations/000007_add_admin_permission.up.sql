@@ -0,0 +1,6 @@
+ALTER TABLE permissions ADD CONSTRAINT permissions_code_key UNIQUE (code);
+
+INSERT INTO permissions (code)
+VALUES
+    ('users:admin')
+ON CONFLICT (code) DO NOTHING;
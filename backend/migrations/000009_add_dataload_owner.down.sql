@@ -0,0 +1,5 @@
+DELETE FROM permissions WHERE code = 'dataload:admin';
+
+DROP INDEX IF EXISTS dataload_owner_id_idx;
+
+ALTER TABLE dataload DROP COLUMN IF EXISTS owner_id;
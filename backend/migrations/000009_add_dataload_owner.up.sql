@@ -0,0 +1,14 @@
+ALTER TABLE dataload ADD COLUMN IF NOT EXISTS owner_id bigint REFERENCES users ON DELETE CASCADE;
+
+CREATE INDEX IF NOT EXISTS dataload_owner_id_idx ON dataload (owner_id);
+
+INSERT INTO permissions (code)
+VALUES
+    ('dataload:admin')
+ON CONFLICT (code) DO NOTHING;
+
+INSERT INTO roles_permissions
+SELECT roles.id, permissions.id
+FROM roles, permissions
+WHERE roles.name = 'admin' AND permissions.code = 'dataload:admin'
+ON CONFLICT DO NOTHING;
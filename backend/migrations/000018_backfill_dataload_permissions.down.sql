@@ -0,0 +1,3 @@
+-- The backfilled grants look the same as ones made by an admin afterwards,
+-- so rolling back leaves them in place
+SELECT 1;
@@ -0,0 +1,8 @@
+-- Before permissions were enforced every activated user could read and write
+-- dataload rows. Accounts that existed then keep both, new sign ups only get
+-- dataload:read from the register handler
+INSERT INTO users_permissions
+SELECT users.id, permissions.id
+FROM users, permissions
+WHERE permissions.code IN ('dataload:read', 'dataload:write')
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,187 @@
+package models
+
+import (
+	"backend/validator"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Every API key starts with this so it can be told apart from other bearer tokens
+const APIKeyPrefix = "apikey_"
+
+// APIKey is a long lived credential for machine clients. It can only use the
+// permissions listed on it, and only while its owner still holds them too
+type APIKey struct {
+	ID          int64       `json:"id"`
+	UserID      int64       `json:"-"`
+	Name        string      `json:"name"`
+	Plaintext   string      `json:"key,omitempty"`
+	Hash        []byte      `json:"-"`
+	Permissions Permissions `json:"permissions"`
+	Expiry      *time.Time  `json:"expiry,omitempty"`
+	CreatedAt   time.Time   `json:"created_at"`
+}
+
+func ValidateAPIKey(v *validator.Validator, key *APIKey, allowed Permissions) {
+	v.Check(key.Name != "", "name", "must be provided")
+	v.Check(len(key.Name) <= 72, "name", "must not be longer than 72")
+	v.Check(key.Expiry == nil || key.Expiry.After(time.Now()), "expiry", "must be in the future")
+	v.Check(validator.Unique(key.Permissions), "permissions", "must not contain duplicate values")
+
+	for _, code := range key.Permissions {
+		v.Check(allowed.Include(code), "permissions", "you do not hold the permission "+code)
+	}
+}
+
+// Looks like an API key rather than an opaque token or a JWT
+func IsAPIKey(plaintext string) bool {
+	return strings.HasPrefix(plaintext, APIKeyPrefix)
+}
+
+// Generates the key, stores only its hash and fills in the ID and plaintext
+func (m *DBModel) InsertAPIKey(key *APIKey) error {
+	randomBytes := make([]byte, 32)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return err
+	}
+
+	key.Plaintext = APIKeyPrefix + strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes))
+
+	hash := sha256.Sum256([]byte(key.Plaintext))
+	key.Hash = hash[:]
+
+	if key.Permissions == nil {
+		key.Permissions = Permissions{}
+	}
+
+	query := `
+		INSERT INTO api_keys (user_id, name, hash, permissions, expiry)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at`
+
+	args := []interface{}{key.UserID, key.Name, key.Hash, pq.Array([]string(key.Permissions)), key.Expiry}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&key.ID, &key.CreatedAt)
+}
+
+func (m *DBModel) GetAPIKeysForUser(userID int64) ([]*APIKey, error) {
+	query := `SELECT id, user_id, name, permissions, expiry, created_at FROM api_keys WHERE user_id = $1 ORDER BY id`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+
+	for rows.Next() {
+		var key APIKey
+
+		err := rows.Scan(&key.ID, &key.UserID, &key.Name, pq.Array((*[]string)(&key.Permissions)), &key.Expiry, &key.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, &key)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+func (m *DBModel) DeleteAPIKey(id, userID int64) error {
+	query := `DELETE FROM api_keys WHERE id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	results, err := m.DB.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := results.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// GetForAPIKey finds the owner of an unexpired key along with the key itself
+func (m *DBModel) GetForAPIKey(plaintext string) (*User, *APIKey, error) {
+	hash := sha256.Sum256([]byte(plaintext))
+
+	query := `
+		SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated,
+		users.deletion_requested_at, users.suspended_at, users.suspended_until, users.suspension_reason, users.version, users.token_version,
+		api_keys.id, api_keys.name, api_keys.permissions, api_keys.expiry, api_keys.created_at
+		FROM users
+		INNER JOIN api_keys ON users.id = api_keys.user_id
+		WHERE api_keys.hash = $1 AND (api_keys.expiry IS NULL OR api_keys.expiry > $2)`
+
+	var (
+		user User
+		key  APIKey
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, hash[:], time.Now()).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.DeletionRequestedAt,
+		&user.SuspendedAt,
+		&user.SuspendedUntil,
+		&user.SuspensionReason,
+		&user.Version,
+		&user.TokenVersion,
+		&key.ID,
+		&key.Name,
+		pq.Array((*[]string)(&key.Permissions)),
+		&key.Expiry,
+		&key.CreatedAt,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+
+	key.UserID = user.ID
+
+	return &user, &key, nil
+}
@@ -69,3 +69,8 @@ func createMetadata(totalRecords, page, pagesize int) Metadata {
 		TotalRecords: totalRecords,
 	}
 }
+
+// Makes user input match literally inside a LIKE pattern using ESCAPE '\'
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
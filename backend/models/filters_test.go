@@ -0,0 +1,19 @@
+package models
+
+import "testing"
+
+func TestEscapeLike(t *testing.T) {
+	tests := map[string]string{
+		"jane@example.com": "jane@example.com",
+		"_":                `\_`,
+		"100%":             `100\%`,
+		`a\b`:              `a\\b`,
+		`\%_`:              `\\\%\_`,
+	}
+
+	for input, want := range tests {
+		if got := escapeLike(input); got != want {
+			t.Errorf("escapeLike(%q) = %q, want %q", input, got, want)
+		}
+	}
+}
@@ -4,109 +4,76 @@ import (
 	"context"
 	"database/sql"
 	"errors"
-	"fmt"
 	"time"
 	"crypto/sha256"
 )
 
 func (m *DBModel) Insert(user *User) error {
-	query := `INSERT INTO users (name, email, password_hash, activated) VALUES ($1, $2, $3, $4) RETURNING id, created_at, version`
-
-	args := []interface{}{user.Name, user.Email, user.Password.hash, user.Activated}
-	
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
-	if err != nil {
-		switch {
-		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
-			return ErrDuplicateEmail 
-		default:
-			return err
-		}
-	}
-	return nil
+	return insertUser(ctx, m.DB, user)
 }
 
-
-func (m *DBModel) GetData(id int64) (*DBLoad, error) {
-	if id < 1 {
-		return nil, ErrRecordNotFound
-	}
-
-	query := `SELECT dbdataone, dbdatatwo, dbdatathree, version from dataload where id = $1`
-
-	var load DBLoad
-
+// Inserts the user and grants the permission codes in one transaction, so a
+// failure can not leave behind a user without their starting permissions
+func (m *DBModel) InsertWithPermissions(user *User, codes ...string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, id).Scan(
-		&load.DBDataOne,
-		&load.DBDataTwo,
-		&load.DBDataThree,
-		&load.Version,
-	)
-
+	tx, err := m.DB.BeginTx(ctx, nil)
 	if err != nil {
-		switch {
-		case errors.Is(err, sql.ErrNoRows):
-			return nil, ErrRecordNotFound
-		default:
-			return nil, err
-		}
-	}
-
-	return &load, nil
-}
-
-func (m *DBModel) InsertDBLoad(load *DBLoad) error {
-	query := `insert into dataload(dbdataone, dbdatatwo, dbdatathree) VALUES($1, $2, $3) returning version`
-
-	args := []interface{}{load.DBDataOne, load.DBDataTwo, load.DBDataThree}
-
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	return m.DB.QueryRowContext(ctx, query, args...).Scan(&load.DBDataOne)
-}
-
-func (m *DBModel) Delete(id int64) error {
-	if id < 1 {
-		return ErrRecordNotFound
+		return err
 	}
+	defer tx.Rollback()
 
-	query := `DELETE FROM dataload where id = $1`
-
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	results, err := m.DB.ExecContext(ctx, query, id)
+	err = insertUser(ctx, tx, user)
 	if err != nil {
 		return err
 	}
 
-	rowsAffected, err := results.RowsAffected()
+	err = addPermissionsForUser(ctx, tx, user.ID, codes...)
 	if err != nil {
 		return err
 	}
 
-	if rowsAffected == 0 {
-		return ErrRecordNotFound
-	}
+	return tx.Commit()
+}
 
+func insertUser(ctx context.Context, db rowQueryer, user *User) error {
+	query := `INSERT INTO users (name, email, password_hash, activated) VALUES ($1, $2, $3, $4) RETURNING id, created_at, version`
+
+	args := []interface{}{user.Name, user.Email, user.Password.hash, user.Activated}
+
+	err := db.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
+			return ErrDuplicateEmail
+		default:
+			return err
+		}
+	}
 	return nil
 }
 
 func (m *DBModel) UpdateUser(user *User) error {
-	query := `UPDATE users SET name = $1, email = $2, password_hash = $3, activated = $4, version = version + 1 WHERE id = $5 AND version = $6 RETURNING version`
+	query := `
+		UPDATE users
+		SET name = $1, email = $2, password_hash = $3, activated = $4, deletion_requested_at = $5,
+		suspended_at = $6, suspended_until = $7, suspension_reason = $8, version = version + 1
+		WHERE id = $9 AND version = $10
+		RETURNING version`
 
 	args := []interface{}{
 		user.Name,
 		user.Email,
 		user.Password.hash,
 		user.Activated,
+		user.DeletionRequestedAt,
+		user.SuspendedAt,
+		user.SuspendedUntil,
+		user.SuspensionReason,
 		user.ID,
 		user.Version,
 	}
@@ -129,7 +96,7 @@ func (m *DBModel) UpdateUser(user *User) error {
 }
 
 func (m *DBModel) GetUserByEmail(email string) (*User, error) {
-	query := `SELECT id, created_at, name, email, password_hash, activated, version FROM users WHERE email = $1`
+	query := `SELECT id, created_at, name, email, password_hash, activated, deletion_requested_at, suspended_at, suspended_until, suspension_reason, version, token_version FROM users WHERE email = $1`
 
 	var user User
 
@@ -143,7 +110,12 @@ func (m *DBModel) GetUserByEmail(email string) (*User, error) {
 		&user.Email,
 		&user.Password.hash,
 		&user.Activated,
+		&user.DeletionRequestedAt,
+		&user.SuspendedAt,
+		&user.SuspendedUntil,
+		&user.SuspensionReason,
 		&user.Version,
+		&user.TokenVersion,
 	)
 
 	if err != nil {
@@ -158,83 +130,10 @@ func (m *DBModel) GetUserByEmail(email string) (*User, error) {
 	return &user, nil
 } 
 
-// This updates the database info - not the user
-func (m *DBModel) Update(load *DBLoad) error {
-	// This will handle DB update race condition
-	query := `UPDATE dbload SET dbdataone = $1, dbdatatwo = $2, dbdatathree = $3, version = version + 1 where id = $4 and VERSION = $5 RETURNING version`
-
-	args := []interface{}{
-		load.DBDataOne,
-		load.DBDataTwo,
-		load.DBDataThree,
-		load.ID,
-		load.Version,
-	}
-
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&load.Version)
-	if err != nil {
-		switch {
-		case errors.Is(err, sql.ErrNoRows):
-			return ErrEditConflict
-		default:
-			return err
-		}
-	}
-	return nil
-}
-
-func (m *DBModel) GetAll(DBDataOne string, filters Filters) ([]*DBLoad, Metadata, error) {
-	query := fmt.Sprintf(`SELECT count(*) OVER(), dbdataone, dbdatatwo, dbdatathree, id, version FROM dbload WHERE(to_tsvector('simple', dbdataone) @@ plainto_tsquery('simple', $1) OR $1='') ORDER BY %s %s, id ASC LIMIT $2 OFFSET $3`, filters.sortColumn(), filters.sortDirection())
-
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	args := []interface{}{DBDataOne, filters.limit(), filters.offset()}
-	rows, err := m.DB.QueryContext(ctx, query, args...)
-	if err != nil {
-		return nil, Metadata{}, err
-	}
-
-	defer rows.Close()
-
-	totalRecords := 0
-	DBdata := []*DBLoad{}
-
-	for rows.Next() {
-		var data DBLoad
-
-		err := rows.Scan(
-			&totalRecords,
-			&data.DBDataOne,
-			&data.DBDataTwo,
-			&data.DBDataThree,
-			&data.ID,
-			&data.Version,
-		)
-
-		if err != nil {
-			return nil, Metadata{}, err
-		}
-
-		DBdata = append(DBdata, &data)
-	}
-
-	if err = rows.Err(); err != nil {
-		return nil, Metadata{}, err
-	}
-
-	metadata := createMetadata(totalRecords, filters.Page, filters.PageSize)
-
-	return DBdata, metadata, nil
-}
-
 func (m *DBModel) GetForToken(tokenScope, TokenPlaintext string) (*User, error) {
 	tokenHash := sha256.Sum256([]byte(TokenPlaintext))
 
-	query := `SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version FROM users INNER JOIN tokens ON users.id = tokens.user_id WHERE tokens.hash = $1 AND tokens.scope = $2 AND tokens.expiry > $3`
+	query := `SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.deletion_requested_at, users.suspended_at, users.suspended_until, users.suspension_reason, users.version, users.token_version FROM users INNER JOIN tokens ON users.id = tokens.user_id WHERE tokens.hash = $1 AND tokens.scope = $2 AND tokens.expiry > $3`
 
 	args := []interface{}{tokenHash[:], tokenScope, time.Now()}
 
@@ -250,7 +149,12 @@ func (m *DBModel) GetForToken(tokenScope, TokenPlaintext string) (*User, error)
 		&user.Email,
 		&user.Password.hash,
 		&user.Activated,
+		&user.DeletionRequestedAt,
+		&user.SuspendedAt,
+		&user.SuspendedUntil,
+		&user.SuspensionReason,
 		&user.Version,
+		&user.TokenVersion,
 	)
 
 	if err != nil {
@@ -264,3 +168,4 @@ func (m *DBModel) GetForToken(tokenScope, TokenPlaintext string) (*User, error)
 
 	return &user, nil
 }
+
@@ -0,0 +1,163 @@
+package models
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrUnknownHash = errors.New("unknown password hash format")
+
+// Hasher is one way of turning passwords into the password_hash column. Every
+// hash starts with a $id$ prefix so old hashes keep working after a switch
+type Hasher interface {
+	Hash(plaintext string) ([]byte, error)
+	Matches(plaintext string, hash []byte) (bool, error)
+
+	// Outdated reports whether a hash should be redone with this hasher
+	Outdated(hash []byte) bool
+
+	// MaxLength is the longest password the algorithm can take in full
+	MaxLength() int
+}
+
+// PasswordHasher creates every new hash. main swaps it for the configured one
+var PasswordHasher Hasher = NewArgon2id(64*1024, 3, 2)
+
+// Picks the hasher that can check a stored hash, whatever is configured now
+func hasherFor(hash []byte) (Hasher, error) {
+	switch {
+	case bytes.HasPrefix(hash, []byte("$argon2id$")):
+		return Argon2id{}, nil
+	case bytes.HasPrefix(hash, []byte("$2a$")), bytes.HasPrefix(hash, []byte("$2b$")), bytes.HasPrefix(hash, []byte("$2y$")):
+		return Bcrypt{}, nil
+	default:
+		return nil, ErrUnknownHash
+	}
+}
+
+// Bcrypt only looks at the first 72 bytes of a password
+type Bcrypt struct {
+	Cost int
+}
+
+func (h Bcrypt) Hash(plaintext string) ([]byte, error) {
+	return bcrypt.GenerateFromPassword([]byte(plaintext), h.Cost)
+}
+
+func (h Bcrypt) Matches(plaintext string, hash []byte) (bool, error) {
+	err := bcrypt.CompareHashAndPassword(hash, []byte(plaintext))
+	if err != nil {
+		switch {
+		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (h Bcrypt) Outdated(hash []byte) bool {
+	cost, err := bcrypt.Cost(hash)
+	return err != nil || cost != h.Cost
+}
+
+func (h Bcrypt) MaxLength() int {
+	return 72
+}
+
+// Argon2id hashes are stored in the PHC string format, e.g.
+// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>
+type Argon2id struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+}
+
+const (
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+)
+
+func NewArgon2id(memory, iterations uint32, parallelism uint8) Argon2id {
+	return Argon2id{Memory: memory, Iterations: iterations, Parallelism: parallelism}
+}
+
+func (h Argon2id) Hash(plaintext string) ([]byte, error) {
+	salt := make([]byte, argon2SaltLength)
+
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	key := argon2.IDKey([]byte(plaintext), salt, h.Iterations, h.Memory, h.Parallelism, argon2KeyLength)
+
+	encoded := fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.Memory, h.Iterations, h.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key))
+
+	return []byte(encoded), nil
+}
+
+// The parameters come from the hash itself, not from the receiver
+func (h Argon2id) Matches(plaintext string, hash []byte) (bool, error) {
+	params, salt, key, err := decodeArgon2id(hash)
+	if err != nil {
+		return false, err
+	}
+
+	other := argon2.IDKey([]byte(plaintext), salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(key)))
+
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+func (h Argon2id) Outdated(hash []byte) bool {
+	params, _, _, err := decodeArgon2id(hash)
+	return err != nil || params != h
+}
+
+func (h Argon2id) MaxLength() int {
+	return 256
+}
+
+func decodeArgon2id(hash []byte) (Argon2id, []byte, []byte, error) {
+	var params Argon2id
+	var version int
+
+	parts := strings.Split(string(hash), "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, ErrUnknownHash
+	}
+
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return params, nil, nil, ErrUnknownHash
+	}
+
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism)
+	if err != nil {
+		return params, nil, nil, ErrUnknownHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, ErrUnknownHash
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, ErrUnknownHash
+	}
+
+	return params, salt, key, nil
+}
@@ -0,0 +1,183 @@
+package models
+
+import (
+	"backend/validator"
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Cheap parameters so the tests stay fast
+var testArgon2id = NewArgon2id(64, 1, 1)
+
+func TestArgon2idRoundTrip(t *testing.T) {
+	hash, err := testArgon2id.Hash("pa55word")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(string(hash), "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Errorf("hash = %s", hash)
+	}
+
+	params, salt, key, err := decodeArgon2id(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if params != testArgon2id {
+		t.Errorf("decoded params = %+v, want %+v", params, testArgon2id)
+	}
+	if len(salt) != argon2SaltLength || len(key) != argon2KeyLength {
+		t.Errorf("salt length = %d, key length = %d", len(salt), len(key))
+	}
+
+	tests := []struct {
+		plaintext string
+		want      bool
+	}{
+		{"pa55word", true},
+		{"pa55wOrd", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		// Any receiver will do, the parameters come from the hash
+		ok, err := Argon2id{}.Matches(tt.plaintext, hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != tt.want {
+			t.Errorf("Matches(%q) = %v, want %v", tt.plaintext, ok, tt.want)
+		}
+	}
+}
+
+func TestDecodeArgon2idRejectsMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		hash string
+	}{
+		{"empty", ""},
+		{"bcrypt", "$2a$10$abcdefghijklmnopqrstuu"},
+		{"argon2i", "$argon2i$v=19$m=64,t=1,p=1$c2FsdHNhbHQ$a2V5"},
+		{"old version", "$argon2id$v=16$m=64,t=1,p=1$c2FsdHNhbHQ$a2V5"},
+		{"bad params", "$argon2id$v=19$m=x,t=1,p=1$c2FsdHNhbHQ$a2V5"},
+		{"bad salt", "$argon2id$v=19$m=64,t=1,p=1$!!!$a2V5"},
+		{"empty key", "$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHQ$"},
+		{"extra part", "$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHQ$a2V5$"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, _, err := decodeArgon2id([]byte(tt.hash))
+			if !errors.Is(err, ErrUnknownHash) {
+				t.Errorf("err = %v, want ErrUnknownHash", err)
+			}
+		})
+	}
+}
+
+func TestOutdated(t *testing.T) {
+	argonHash, err := testArgon2id.Hash("pa55word")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bcryptHash, err := Bcrypt{Cost: bcrypt.MinCost}.Hash("pa55word")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		hasher Hasher
+		hash   []byte
+		want   bool
+	}{
+		{"argon2id same params", testArgon2id, argonHash, false},
+		{"argon2id more memory", NewArgon2id(128, 1, 1), argonHash, true},
+		{"argon2id more iterations", NewArgon2id(64, 2, 1), argonHash, true},
+		{"argon2id more threads", NewArgon2id(64, 1, 2), argonHash, true},
+		{"argon2id over bcrypt", testArgon2id, bcryptHash, true},
+		{"argon2id over garbage", testArgon2id, []byte("garbage"), true},
+		{"bcrypt same cost", Bcrypt{Cost: bcrypt.MinCost}, bcryptHash, false},
+		{"bcrypt higher cost", Bcrypt{Cost: bcrypt.MinCost + 1}, bcryptHash, true},
+		{"bcrypt over argon2id", Bcrypt{Cost: bcrypt.MinCost}, argonHash, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.hasher.Outdated(tt.hash); got != tt.want {
+				t.Errorf("Outdated = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Users who signed up before the switch to argon2id still have bcrypt hashes
+func TestBcryptHashUnderArgon2idDefault(t *testing.T) {
+	if _, ok := PasswordHasher.(Argon2id); !ok {
+		t.Fatalf("default PasswordHasher is %T, want Argon2id", PasswordHasher)
+	}
+
+	hash, err := Bcrypt{Cost: bcrypt.MinCost}.Hash("pa55word")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := password{hash: hash}
+
+	tests := []struct {
+		plaintext string
+		want      bool
+	}{
+		{"pa55word", true},
+		{"pa55wOrd", false},
+	}
+
+	for _, tt := range tests {
+		ok, err := p.Matches(tt.plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != tt.want {
+			t.Errorf("Matches(%q) = %v, want %v", tt.plaintext, ok, tt.want)
+		}
+	}
+
+	if !p.NeedsRehash() {
+		t.Error("NeedsRehash = false for a bcrypt hash under argon2id")
+	}
+
+	_, err = (&password{hash: []byte("$1$md5crypt")}).Matches("pa55word")
+	if !errors.Is(err, ErrUnknownHash) {
+		t.Errorf("Matches on an unknown hash err = %v, want ErrUnknownHash", err)
+	}
+}
+
+// Switching to bcrypt must not lock out a long password hashed with argon2id,
+// while new passwords are held to what bcrypt can take
+func TestPasswordLengthUnderBcrypt(t *testing.T) {
+	defer func(h Hasher) { PasswordHasher = h }(PasswordHasher)
+	PasswordHasher = Bcrypt{Cost: bcrypt.MinCost}
+
+	long := strings.Repeat("Lo9g!", 20)
+
+	v := validator.New()
+	if ValidatePasswordPlaintext(v, long); !v.Valid() {
+		t.Errorf("login with a %d byte password: %v", len(long), v.Errors)
+	}
+
+	v = validator.New()
+	if ValidateNewPassword(v, long, &User{}); v.Valid() {
+		t.Errorf("new %d byte password accepted under bcrypt", len(long))
+	}
+
+	v = validator.New()
+	if ValidatePasswordPlaintext(v, strings.Repeat("a", maxPasswordLength+1)); v.Valid() {
+		t.Errorf("login with a %d byte password accepted", maxPasswordLength+1)
+	}
+}
@@ -0,0 +1,191 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"time"
+)
+
+var ErrDuplicateIdentity = errors.New("duplicate identity")
+
+// Identity links an account at an external sign in provider to one of our users
+type Identity struct {
+	ID        int64     `json:"id"`
+	UserID    int64     `json:"-"`
+	Provider  string    `json:"provider"`
+	Subject   string    `json:"subject"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (m *DBModel) GetUserForIdentity(provider, subject string) (*User, error) {
+	query := `
+		SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.deletion_requested_at, users.suspended_at, users.suspended_until, users.suspension_reason, users.version, users.token_version
+		FROM users
+		INNER JOIN user_identities ON user_identities.user_id = users.id
+		WHERE user_identities.provider = $1
+		AND user_identities.subject = $2`
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, provider, subject).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.DeletionRequestedAt,
+		&user.SuspendedAt,
+		&user.SuspendedUntil,
+		&user.SuspensionReason,
+		&user.Version,
+		&user.TokenVersion,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
+func (m *DBModel) InsertIdentity(identity *Identity) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return insertIdentity(ctx, m.DB, identity)
+}
+
+// Creates a brand new user together with the identity they signed in with
+// and grants the permission codes, all in one transaction
+func (m *DBModel) InsertUserWithIdentity(user *User, identity *Identity, codes ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = insertUser(ctx, tx, user)
+	if err != nil {
+		return err
+	}
+
+	identity.UserID = user.ID
+
+	err = insertIdentity(ctx, tx, identity)
+	if err != nil {
+		return err
+	}
+
+	err = addPermissionsForUser(ctx, tx, user.ID, codes...)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+type rowQueryer interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func insertIdentity(ctx context.Context, db rowQueryer, identity *Identity) error {
+	query := `
+		INSERT INTO user_identities (user_id, provider, subject, email)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at`
+
+	args := []interface{}{identity.UserID, identity.Provider, identity.Subject, identity.Email}
+
+	err := db.QueryRowContext(ctx, query, args...).Scan(&identity.ID, &identity.CreatedAt)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "user_identities_provider_subject_key"`:
+			return ErrDuplicateIdentity
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Remembers the PKCE verifier behind a sign in attempt and returns the state
+// value that will come back to us with the authorization code
+func (m *DBModel) NewOAuthState(provider, verifier string, ttl time.Duration) (string, error) {
+	randomBytes := make([]byte, 32)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+
+	state := base64.RawURLEncoding.EncodeToString(randomBytes)
+	hash := sha256.Sum256([]byte(state))
+
+	query := `INSERT INTO oauth_states (hash, provider, verifier, expiry) VALUES ($1, $2, $3, $4)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, query, hash[:], provider, verifier, time.Now().Add(ttl))
+	if err != nil {
+		return "", err
+	}
+
+	return state, nil
+}
+
+// Uses up a state value and hands back its verifier. Each state works once
+func (m *DBModel) ConsumeOAuthState(provider, state string) (string, error) {
+	hash := sha256.Sum256([]byte(state))
+
+	query := `
+		DELETE FROM oauth_states
+		WHERE hash = $1 AND provider = $2 AND expiry > $3
+		RETURNING verifier`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var verifier string
+
+	err := m.DB.QueryRowContext(ctx, query, hash[:], provider, time.Now()).Scan(&verifier)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return "", ErrRecordNotFound
+		default:
+			return "", err
+		}
+	}
+
+	return verifier, nil
+}
+
+// Drops sign in attempts that were started but never finished
+func (m *DBModel) PurgeOAuthStates() error {
+	query := `DELETE FROM oauth_states WHERE expiry < $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, time.Now())
+	return err
+}
@@ -0,0 +1,111 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Failed logins are counted per key, which is either an email or an IP address
+type LoginAttempt struct {
+	Key           string
+	Failures      int
+	LastFailureAt time.Time
+	LockedUntil   *time.Time
+}
+
+func (m *DBModel) GetLoginAttempt(key string) (*LoginAttempt, error) {
+	query := `SELECT key, failures, last_failure_at, locked_until FROM login_attempts WHERE key = $1`
+
+	var attempt LoginAttempt
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, key).Scan(
+		&attempt.Key,
+		&attempt.Failures,
+		&attempt.LastFailureAt,
+		&attempt.LockedUntil,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &attempt, nil
+}
+
+// Counts one more failure against the key and returns the updated row
+func (m *DBModel) RecordLoginFailure(key string) (*LoginAttempt, error) {
+	query := `
+		INSERT INTO login_attempts (key, failures, last_failure_at) VALUES ($1, 1, NOW())
+		ON CONFLICT (key) DO UPDATE SET failures = login_attempts.failures + 1, last_failure_at = NOW()
+		RETURNING key, failures, last_failure_at, locked_until`
+
+	var attempt LoginAttempt
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, key).Scan(
+		&attempt.Key,
+		&attempt.Failures,
+		&attempt.LastFailureAt,
+		&attempt.LockedUntil,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &attempt, nil
+}
+
+// Locks the key out and starts counting failures again from zero
+func (m *DBModel) LockLogin(key string, until time.Time) error {
+	query := `UPDATE login_attempts SET failures = 0, locked_until = $2 WHERE key = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, key, until)
+	return err
+}
+
+func (m *DBModel) ClearLoginFailures(key string) error {
+	query := `DELETE FROM login_attempts WHERE key = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, key)
+	return err
+}
+
+// Takes n failures back off the key without touching a lock already in place
+func (m *DBModel) ForgiveLoginFailures(key string, n int) error {
+	query := `UPDATE login_attempts SET failures = GREATEST(failures - $2, 0) WHERE key = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, key, n)
+	return err
+}
+
+// Drops rows nobody has failed against since the cutoff and that are not locked
+func (m *DBModel) PurgeLoginAttempts(cutoff time.Time) error {
+	query := `DELETE FROM login_attempts WHERE last_failure_at < $1 AND (locked_until IS NULL OR locked_until < NOW())`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, cutoff)
+	return err
+}
@@ -4,12 +4,14 @@ import (
 	"backend/validator"
 	"database/sql"
 	"errors"
+	"fmt"
 	"time"
-	"golang.org/x/crypto/bcrypt"
 )
 
 type Models struct {
 	DB DBModel
+
+	DataLoad *Repository[DBLoad]
 }
 
 type DBModel struct {
@@ -20,11 +22,14 @@ var (
 	ErrRecordNotFound = errors.New("record not found")
 	ErrEditConflict   = errors.New("edit conflict")
 	ErrDuplicateEmail = errors.New("duplicate email")
+	ErrTokenReused    = errors.New("token reused")
+	ErrDuplicateRole  = errors.New("duplicate role")
 )
 
 func NewModels(db *sql.DB) Models {
 	return Models{
-		DB: DBModel{DB: db},
+		DB:       DBModel{DB: db},
+		DataLoad: NewRepository(db, DataLoadResource),
 	}
 }
 
@@ -36,7 +41,18 @@ type User struct {
 	Email     string    `json:"email"`
 	Password  password  `json:"-"`
 	Activated bool      `json:"activated"`
-	Version   int       `json:"-"`
+	Version   int       `json:"version"`
+
+	// Bumped to invalidate every JWT issued to the user so far
+	TokenVersion int `json:"-"`
+
+	// Set while the account waits out its grace period before being purged
+	DeletionRequestedAt *time.Time `json:"deletion_requested_at,omitempty"`
+
+	// A suspension with no end date lasts until an admin lifts it
+	SuspendedAt      *time.Time `json:"suspended_at,omitempty"`
+	SuspendedUntil   *time.Time `json:"suspended_until,omitempty"`
+	SuspensionReason string     `json:"suspension_reason,omitempty"`
 }
 
 type password struct {
@@ -50,8 +66,19 @@ func (u *User) IsAnonymous() bool {
 	return u == AnonymousUser
 }
 
+func (u *User) IsPendingDeletion() bool {
+	return u.DeletionRequestedAt != nil
+}
+
+func (u *User) IsSuspended() bool {
+	if u.SuspendedAt == nil {
+		return false
+	}
+	return u.SuspendedUntil == nil || u.SuspendedUntil.After(time.Now())
+}
+
 func (p *password) Set(plaintextPassword string) error {
-	hash, err := bcrypt.GenerateFromPassword([]byte(plaintextPassword), 12)
+	hash, err := PasswordHasher.Hash(plaintextPassword)
 	if err != nil {
 		return err
 	}
@@ -63,16 +90,18 @@ func (p *password) Set(plaintextPassword string) error {
 }
 
 func (p *password) Matches(plaintextPassword string) (bool, error) {
-	err := bcrypt.CompareHashAndPassword(p.hash, []byte(plaintextPassword))
+	hasher, err := hasherFor(p.hash)
 	if err != nil {
-		switch {
-		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
-			return false, nil
-		default:
-			return false, err
-		}
+		return false, err
 	}
-	return true, nil
+
+	return hasher.Matches(plaintextPassword, p.hash)
+}
+
+// NeedsRehash is true when the stored hash uses an older algorithm or cost
+// than the one we hash new passwords with
+func (p *password) NeedsRehash() bool {
+	return PasswordHasher.Outdated(p.hash)
 }
 
 func ValidateEmail(v *validator.Validator, email string) {
@@ -80,10 +109,25 @@ func ValidateEmail(v *validator.Validator, email string) {
 	v.Check(validator.Matches(email, validator.EmailRX), "email", "must be a valid email address")
 }
 
+// Longest password any hasher we support has stored. Logins are held to this
+// rather than the current hasher's limit, so moving to bcrypt does not lock
+// out argon2id users with longer passwords
+const maxPasswordLength = 256
+
 func ValidatePasswordPlaintext(v *validator.Validator, password string) {
 	v.Check(password != "", "password", "must be provided")
 	v.Check(len(password) >= 8, "password", "password must be atleast 8 chars long")
-	v.Check(len(password) <= 72, "password", "password must not  be more than 72 chars long")
+	v.Check(len(password) <= maxPasswordLength, "password", fmt.Sprintf("password must not be more than %d chars long", maxPasswordLength))
+}
+
+// PasswordPolicy applies to every password a user picks. main sets it from the flags
+var PasswordPolicy = &validator.PasswordPolicy{MinLength: 8, MinClasses: 2, MinEntropy: 40}
+
+// ValidateNewPassword is for passwords being set, logins only need ValidatePasswordPlaintext
+func ValidateNewPassword(v *validator.Validator, password string, user *User) {
+	ValidatePasswordPlaintext(v, password)
+	v.Check(len(password) <= PasswordHasher.MaxLength(), "password", fmt.Sprintf("password must not be more than %d chars long", PasswordHasher.MaxLength()))
+	PasswordPolicy.Check(v, "password", password, user.Email, user.Name)
 }
 
 func ValidateUser(v *validator.Validator, user *User) {
@@ -93,7 +137,7 @@ func ValidateUser(v *validator.Validator, user *User) {
 	ValidateEmail(v, user.Email)
 
 	if user.Password.plaintext != nil {
-		ValidatePasswordPlaintext(v, *user.Password.plaintext)
+		ValidateNewPassword(v, *user.Password.plaintext, user)
 	}
 
 	if user.Password.hash == nil {
@@ -109,11 +153,25 @@ type Payload struct {
 }
 
 type DBLoad struct {
-	DBDataOne   string `json:db_data_one`
-	DBDataTwo   string `json:db_data_two`
-	DBDataThree string `json:db_data_three`
-	ID          int64  `json:id`
-	Version     int32  `json:version`
+	Record
+	DBDataOne   string `json:"db_data_one" db:"dbdataone"`
+	DBDataTwo   string `json:"db_data_two" db:"dbdatatwo"`
+	DBDataThree string `json:"db_data_three" db:"dbdatathree"`
+}
+
+// The dataload table served through the generic resource routes
+var DataLoadResource = Resource[DBLoad]{
+	Name:         "data",
+	Key:          "data",
+	ListKey:      "DBdata",
+	Table:        "dataload",
+	Permission:   "dataload",
+	Validate:     ValidateDBLoad,
+	// DBDataOne is the spelling clients used before the generic routes
+	SortFields:   []string{"dbdataone", "dbdatatwo", "dbdatathree", "DBDataOne"},
+	SearchColumn: "dbdataone",
+	// Clients already match on this text, typo and all
+	DeleteMessage: "data deleted Succesfully",
 }
 
 func ValidateDBLoad(v *validator.Validator, dbload *DBLoad) {
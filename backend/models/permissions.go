@@ -1,8 +1,12 @@
 package models
 
 import (
+	"backend/validator"
 	"context"
+	"database/sql"
 	"time"
+
+	"github.com/lib/pq"
 )
 
 type Permissions []string
@@ -17,13 +21,18 @@ func (p Permissions) Include(code string) bool {
 }
 
 func (m *DBModel) GetAllForUser(userID int64) (Permissions, error) {
+	// Effective permissions are the direct grants plus whatever their roles grant
 	query := `
-		SELECT permissions.code	
-		FROM permissions 
-		INNER JOIN users_permissions ON users_permissions.permissions_id = permissions_id
-		INNER JOIN users ON users_permissions.user_id = users.id
-		WHERE users.id = $1
-		`
+		SELECT permissions.code
+		FROM permissions
+		INNER JOIN users_permissions ON users_permissions.permissions_id = permissions.id
+		WHERE users_permissions.user_id = $1
+		UNION
+		SELECT permissions.code
+		FROM permissions
+		INNER JOIN roles_permissions ON roles_permissions.permissions_id = permissions.id
+		INNER JOIN users_roles ON users_roles.role_id = roles_permissions.role_id
+		WHERE users_roles.user_id = $1`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -53,4 +62,83 @@ func (m *DBModel) GetAllForUser(userID int64) (Permissions, error) {
 	}
 
 	return permissions, nil 
-} 
+}
+
+func ValidatePermissionCodes(v *validator.Validator, codes []string, known Permissions) {
+	v.Check(len(codes) > 0, "permissions", "must contain at least one permission")
+	v.Check(validator.Unique(codes), "permissions", "must not contain duplicate values")
+
+	for _, code := range codes {
+		v.Check(known.Include(code), "permissions", "unknown permission code "+code)
+	}
+}
+
+// Every permission code that exists, used to validate grants
+func (m *DBModel) GetAllPermissions() (Permissions, error) {
+	query := `SELECT code FROM permissions ORDER BY code`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	permissions := Permissions{}
+
+	for rows.Next() {
+		var permission string
+
+		err := rows.Scan(&permission)
+		if err != nil {
+			return nil, err
+		}
+
+		permissions = append(permissions, permission)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return permissions, nil
+}
+
+// Grants the codes to the user, codes they already hold are left alone
+func (m *DBModel) AddForUser(userID int64, codes ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return addPermissionsForUser(ctx, m.DB, userID, codes...)
+}
+
+func addPermissionsForUser(ctx context.Context, db execer, userID int64, codes ...string) error {
+	query := `
+		INSERT INTO users_permissions
+		SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
+		ON CONFLICT DO NOTHING`
+
+	_, err := db.ExecContext(ctx, query, userID, pq.Array(codes))
+	return err
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+func (m *DBModel) RemoveForUser(userID int64, codes ...string) error {
+	query := `
+		DELETE FROM users_permissions
+		USING permissions
+		WHERE users_permissions.permissions_id = permissions.id
+		AND users_permissions.user_id = $1
+		AND permissions.code = ANY($2)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
+	return err
+}
@@ -0,0 +1,368 @@
+package models
+
+import (
+	"backend/validator"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Record is embedded in every resource struct. The repository fills it in and
+// clients can never write to it
+type Record struct {
+	ID      int64 `json:"id"`
+	OwnerID int64 `json:"owner_id"`
+	Version int32 `json:"version"`
+}
+
+// Resource declares a table the generic repository and handlers can serve.
+// T is a struct embedding Record, with a db tag on every editable column and
+// a json tag for the name clients use
+type Resource[T any] struct {
+	// Name is the URL segment, e.g. /v1/data
+	Name string
+
+	// Key wraps a single item in responses, ListKey wraps a page of them
+	Key     string
+	ListKey string
+
+	// DeleteMessage answers a delete, "<Key> deleted successfully" when empty
+	DeleteMessage string
+
+	Table string
+
+	// Permissions are <Permission>:read, :write and :admin
+	Permission string
+
+	Validate func(v *validator.Validator, item *T)
+
+	// Columns that can be passed as ?sort=, id is always allowed
+	SortFields []string
+
+	// Optional text column searched with a query param of the same name
+	SearchColumn string
+}
+
+type resourceColumn struct {
+	name  string
+	json  string
+	index []int
+}
+
+// Repository is the CRUD layer for one Resource
+type Repository[T any] struct {
+	DB       *sql.DB
+	Resource Resource[T]
+
+	record  []int
+	columns []resourceColumn
+}
+
+// NewRepository reads the columns off T once. A badly declared resource is a
+// programming error so it panics, the same way an unsafe sort does
+func NewRepository[T any](db *sql.DB, res Resource[T]) *Repository[T] {
+	typ := reflect.TypeOf((*T)(nil)).Elem()
+	if typ.Kind() != reflect.Struct {
+		panic("resource " + res.Name + " must be a struct")
+	}
+
+	repo := &Repository[T]{DB: db, Resource: res}
+
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+
+		if field.Anonymous && field.Type == reflect.TypeOf(Record{}) {
+			repo.record = field.Index
+			continue
+		}
+
+		column := field.Tag.Get("db")
+		if column == "" || column == "-" {
+			continue
+		}
+
+		jsonName := strings.Split(field.Tag.Get("json"), ",")[0]
+		if jsonName == "" {
+			jsonName = field.Name
+		}
+
+		repo.columns = append(repo.columns, resourceColumn{name: column, json: jsonName, index: field.Index})
+	}
+
+	if repo.record == nil || len(repo.columns) == 0 {
+		panic("resource " + res.Name + " must embed models.Record and have db tagged fields")
+	}
+
+	return repo
+}
+
+// SortSafeList is what Filters accepts for this resource
+func (r *Repository[T]) SortSafeList() []string {
+	fields := append([]string{"id"}, r.Resource.SortFields...)
+
+	safeList := make([]string, 0, 2*len(fields))
+	for _, field := range fields {
+		safeList = append(safeList, field, "-"+field)
+	}
+
+	return safeList
+}
+
+// Record returns the embedded Record of an item
+func (r *Repository[T]) Record(item *T) *Record {
+	return reflect.ValueOf(item).Elem().FieldByIndex(r.record).Addr().Interface().(*Record)
+}
+
+func (r *Repository[T]) columnNames() string {
+	names := make([]string, len(r.columns))
+	for i, column := range r.columns {
+		names[i] = column.name
+	}
+	return strings.Join(names, ", ")
+}
+
+// Pointers to the record and column fields in SELECT order
+func (r *Repository[T]) scanDest(item *T) []interface{} {
+	record := r.Record(item)
+	dest := []interface{}{&record.ID, &record.OwnerID, &record.Version}
+
+	value := reflect.ValueOf(item).Elem()
+	for _, column := range r.columns {
+		dest = append(dest, value.FieldByIndex(column.index).Addr().Interface())
+	}
+
+	return dest
+}
+
+func (r *Repository[T]) values(item *T) []interface{} {
+	value := reflect.ValueOf(item).Elem()
+
+	values := make([]interface{}, len(r.columns))
+	for i, column := range r.columns {
+		values[i] = value.FieldByIndex(column.index).Interface()
+	}
+
+	return values
+}
+
+// Patch copies the fields present in a JSON object onto the item. Keys that
+// are not editable columns are an error, so id or version can not be forged
+func (r *Repository[T]) Patch(item *T, input map[string]json.RawMessage) error {
+	return r.patch(item, input, false)
+}
+
+// PatchLenient is Patch the way encoding/json decodes a struct: keys match
+// case insensitively and unknown ones, id and version included, are skipped.
+// It is only there for clients written before the strict routes
+func (r *Repository[T]) PatchLenient(item *T, input map[string]json.RawMessage) error {
+	return r.patch(item, input, true)
+}
+
+func (r *Repository[T]) patch(item *T, input map[string]json.RawMessage, lenient bool) error {
+	value := reflect.ValueOf(item).Elem()
+
+	for key, raw := range input {
+		found := false
+
+		for _, column := range r.columns {
+			if column.json != key && !(lenient && strings.EqualFold(column.json, key)) {
+				continue
+			}
+
+			found = true
+
+			err := json.Unmarshal(raw, value.FieldByIndex(column.index).Addr().Interface())
+			if err != nil {
+				return fmt.Errorf("body contains incorrect JSON type for field %q", key)
+			}
+		}
+
+		if !found && !lenient {
+			return fmt.Errorf("body contains unknown key %q", key)
+		}
+	}
+
+	return nil
+}
+
+func (r *Repository[T]) Get(id int64) (*T, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := fmt.Sprintf(`SELECT id, COALESCE(owner_id, 0), version, %s FROM %s WHERE id = $1`, r.columnNames(), r.Resource.Table)
+
+	item := new(T)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := r.DB.QueryRowContext(ctx, query, id).Scan(r.scanDest(item)...)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return item, nil
+}
+
+// An ownerID of 0 lists every row regardless of who owns it
+func (r *Repository[T]) GetAll(search string, ownerID int64, filters Filters) ([]*T, Metadata, error) {
+	match := "false"
+	if r.Resource.SearchColumn != "" {
+		match = fmt.Sprintf("to_tsvector('simple', %s) @@ plainto_tsquery('simple', $1)", r.Resource.SearchColumn)
+	}
+
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, COALESCE(owner_id, 0), version, %s
+		FROM %s
+		WHERE (%s OR $1 = '')
+		AND (owner_id = $2 OR $2 = 0)
+		ORDER BY %s %s, id ASC
+		LIMIT $3 OFFSET $4`, r.columnNames(), r.Resource.Table, match, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []interface{}{search, ownerID, filters.limit(), filters.offset()}
+	rows, err := r.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	items := []*T{}
+
+	for rows.Next() {
+		item := new(T)
+
+		err := rows.Scan(append([]interface{}{&totalRecords}, r.scanDest(item)...)...)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		items = append(items, item)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := createMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return items, metadata, nil
+}
+
+func (r *Repository[T]) Insert(item *T) error {
+	placeholders := make([]string, len(r.columns))
+	for i := range r.columns {
+		placeholders[i] = fmt.Sprintf("$%d", i+2)
+	}
+
+	query := fmt.Sprintf(`INSERT INTO %s (owner_id, %s) VALUES ($1, %s) RETURNING id, version`,
+		r.Resource.Table, r.columnNames(), strings.Join(placeholders, ", "))
+
+	record := r.Record(item)
+	args := append([]interface{}{record.OwnerID}, r.values(item)...)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return r.DB.QueryRowContext(ctx, query, args...).Scan(&record.ID, &record.Version)
+}
+
+// Update only goes through if nobody changed the row since it was read
+func (r *Repository[T]) Update(item *T) error {
+	sets := make([]string, len(r.columns))
+	for i, column := range r.columns {
+		sets[i] = fmt.Sprintf("%s = $%d", column.name, i+3)
+	}
+
+	query := fmt.Sprintf(`UPDATE %s SET %s, version = version + 1 WHERE id = $1 AND version = $2 RETURNING version`,
+		r.Resource.Table, strings.Join(sets, ", "))
+
+	record := r.Record(item)
+	args := append([]interface{}{record.ID, record.Version}, r.values(item)...)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := r.DB.QueryRowContext(ctx, query, args...).Scan(&record.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *Repository[T]) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := fmt.Sprintf(`DELETE FROM %s WHERE id = $1`, r.Resource.Table)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	results, err := r.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := results.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// Calls fn for each row the user owns, one row at a time, so large exports
+// never have to sit in memory
+func (r *Repository[T]) EachForOwner(ownerID int64, fn func(*T) error) error {
+	query := fmt.Sprintf(`SELECT id, COALESCE(owner_id, 0), version, %s FROM %s WHERE owner_id = $1 ORDER BY id`, r.columnNames(), r.Resource.Table)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	rows, err := r.DB.QueryContext(ctx, query, ownerID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		item := new(T)
+
+		err := rows.Scan(r.scanDest(item)...)
+		if err != nil {
+			return err
+		}
+
+		if err = fn(item); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
@@ -0,0 +1,126 @@
+package models
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func rawInput(t *testing.T, body string) map[string]json.RawMessage {
+	t.Helper()
+
+	var input map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(body), &input); err != nil {
+		t.Fatal(err)
+	}
+	return input
+}
+
+func TestRepositoryPatch(t *testing.T) {
+	repo := NewRepository(nil, DataLoadResource)
+
+	tests := []struct {
+		name    string
+		body    string
+		want    DBLoad
+		wantErr string
+	}{
+		{
+			name: "editable columns",
+			body: `{"db_data_one": "one", "db_data_three": "three"}`,
+			want: DBLoad{Record: Record{ID: 7, OwnerID: 3, Version: 2}, DBDataOne: "one", DBDataTwo: "two", DBDataThree: "three"},
+		},
+		{name: "id", body: `{"id": 99}`, wantErr: `unknown key "id"`},
+		{name: "version", body: `{"version": 99}`, wantErr: `unknown key "version"`},
+		{name: "owner_id", body: `{"owner_id": 99}`, wantErr: `unknown key "owner_id"`},
+		{name: "field name", body: `{"DBDataOne": "one"}`, wantErr: `unknown key "DBDataOne"`},
+		{name: "wrong type", body: `{"db_data_one": 1}`, wantErr: `incorrect JSON type for field "db_data_one"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			item := DBLoad{Record: Record{ID: 7, OwnerID: 3, Version: 2}, DBDataTwo: "two"}
+
+			err := repo.Patch(&item, rawInput(t, tt.body))
+
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if item != tt.want {
+				t.Errorf("item = %+v, want %+v", item, tt.want)
+			}
+		})
+	}
+}
+
+func TestRepositoryPatchLenient(t *testing.T) {
+	repo := NewRepository(nil, DataLoadResource)
+
+	item := DBLoad{Record: Record{ID: 7, OwnerID: 3, Version: 2}}
+
+	body := `{"id": 99, "version": 99, "owner_id": 99, "extra": true, "DB_DATA_ONE": "one", "db_data_two": "two"}`
+
+	err := repo.PatchLenient(&item, rawInput(t, body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := DBLoad{Record: Record{ID: 7, OwnerID: 3, Version: 2}, DBDataOne: "one", DBDataTwo: "two"}
+	if item != want {
+		t.Errorf("item = %+v, want %+v", item, want)
+	}
+}
+
+func TestRepositorySortSafeList(t *testing.T) {
+	repo := NewRepository(nil, Resource[DBLoad]{Name: "test", SortFields: []string{"dbdataone", "dbdatatwo"}})
+
+	want := []string{"id", "-id", "dbdataone", "-dbdataone", "dbdatatwo", "-dbdatatwo"}
+	if got := repo.SortSafeList(); !reflect.DeepEqual(got, want) {
+		t.Errorf("SortSafeList = %q, want %q", got, want)
+	}
+
+	// Sorts older clients send must keep working on the dataload routes
+	safeList := NewRepository(nil, DataLoadResource).SortSafeList()
+	for _, sort := range []string{"id", "DBDataOne"} {
+		f := Filters{Sort: sort, SortSafeList: safeList}
+		if got := f.sortColumn(); got != sort {
+			t.Errorf("sortColumn for %q = %q", sort, got)
+		}
+	}
+}
+
+func TestNewRepositoryPanicsOnBadDeclarations(t *testing.T) {
+	type noRecord struct {
+		Name string `db:"name"`
+	}
+
+	type noColumns struct {
+		Record
+		Name string
+	}
+
+	tests := map[string]func(){
+		"not a struct": func() { NewRepository(nil, Resource[string]{Name: "bad"}) },
+		"no record":    func() { NewRepository(nil, Resource[noRecord]{Name: "bad"}) },
+		"no columns":   func() { NewRepository(nil, Resource[noColumns]{Name: "bad"}) },
+	}
+
+	for name, declare := range tests {
+		t.Run(name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Error("NewRepository did not panic")
+				}
+			}()
+			declare()
+		})
+	}
+}
@@ -1,18 +1,26 @@
 package models
 
 import (
+	"backend/validator"
 	"context"
 	"crypto/rand"
 	"crypto/sha256"
+	"database/sql"
 	"encoding/base32"
+	"errors"
 	"time"
-	//"database/sql"
-	"backend/validator"
+
+	"github.com/lib/pq"
 )
 
 const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
+	ScopeRefresh        = "refresh"
+	ScopePasswordReset  = "password-reset"
+	ScopeCancelDeletion = "cancel-deletion"
+	ScopeMFAPending     = "mfa-pending"
+	ScopeMagicLink      = "magic-link"
 )
 
 type Token struct {
@@ -21,6 +29,27 @@ type Token struct {
 	UserID    int64     `json:"-"`
 	Expiry    time.Time `json:"expiry"`
 	Scope     string    `json:"-"`
+	Family    []byte    `json:"-"`
+	Client    Client    `json:"-"`
+}
+
+// Where a session was started from, recorded on its tokens
+type Client struct {
+	UserAgent string
+	IP        string
+}
+
+// What we are willing to show about a token, the hash never leaves the database
+type TokenMetadata struct {
+	ID         int64      `json:"id"`
+	Scope      string     `json:"scope"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	Expiry     time.Time  `json:"expiry"`
+	UserAgent  string     `json:"user_agent"`
+	IP         string     `json:"ip"`
+	Used       bool       `json:"used"`
+	Current    bool       `json:"current,omitempty"`
 }
 
 // Token validation check
@@ -39,10 +68,24 @@ func (m *DBModel) NewToken(userID int64, ttl time.Duration, scope string) (*Toke
 	return token, err
 }
 
+// Tokens issued from one login share a family so they can be revoked together
+func (m *DBModel) NewTokenInFamily(userID int64, ttl time.Duration, scope string, family []byte, client Client) (*Token, error) {
+	token, err := generateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	token.Family = family
+	token.Client = client
+
+	err = m.InsertToken(token)
+	return token, err
+}
+
 func (m *DBModel) InsertToken(token *Token) error {
-	query := `INSERT INTO tokens (hash, user_id, expiry, scope) VALUES ($1, $2, $3, $4)`
+	query := `INSERT INTO tokens (hash, user_id, expiry, scope, family, user_agent, ip) VALUES ($1, $2, $3, $4, $5, $6, $7)`
 
-	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope}
+	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope, token.Family, token.Client.UserAgent, token.Client.IP}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -61,6 +104,279 @@ func (m *DBModel) DeleteAlForUser(scope string, userID int64) error {
 	return err
 }
 
+// DeleteToken removes a single token along with the rest of its family, so
+// logging out also kills the refresh token that came with the session
+func (m *DBModel) DeleteToken(scope, tokenPlaintext string) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+		DELETE FROM tokens
+		WHERE (hash = $1 AND scope = $2)
+		OR family = (SELECT family FROM tokens WHERE hash = $1 AND scope = $2)`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	results, err := m.DB.ExecContext(ctx, query, tokenHash[:], scope)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := results.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// Drops every session token for the user except the one passed in and the
+// rest of its family. An empty plaintext drops them all
+func (m *DBModel) DeleteOtherSessionsForUser(userID int64, tokenPlaintext string) error {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+		DELETE FROM tokens
+		WHERE user_id = $1
+		AND scope = ANY($2)
+		AND NOT (hash = $3 OR COALESCE(family = (SELECT family FROM tokens WHERE hash = $3), false))`
+
+	args := []interface{}{userID, pq.Array([]string{ScopeAuthentication, ScopeRefresh}), tokenHash[:]}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, args...)
+	return err
+}
+
+// RotateRefreshToken marks the presented refresh token as used and issues the
+// next one in its family, dropping the family's authentication token so one
+// login stays one session. Presenting a token that was already used means it
+// leaked, so the whole family is deleted and ErrTokenReused is returned
+func (m *DBModel) RotateRefreshToken(tokenPlaintext string, ttl time.Duration, client Client) (*Token, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `SELECT user_id, family, used FROM tokens WHERE hash = $1 AND scope = $2 AND expiry > $3 FOR UPDATE`
+
+	var (
+		userID int64
+		family []byte
+		used   bool
+	)
+
+	err = tx.QueryRowContext(ctx, query, tokenHash[:], ScopeRefresh, time.Now()).Scan(&userID, &family, &used)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	if used {
+		_, err = tx.ExecContext(ctx, `DELETE FROM tokens WHERE family = $1`, family)
+		if err != nil {
+			return nil, err
+		}
+
+		if err = tx.Commit(); err != nil {
+			return nil, err
+		}
+		return nil, ErrTokenReused
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE tokens SET used = true WHERE hash = $1`, tokenHash[:])
+	if err != nil {
+		return nil, err
+	}
+
+	// The caller issues a new authentication token next, so the old one goes
+	// now. Otherwise every refresh would leave another live session behind
+	_, err = tx.ExecContext(ctx, `DELETE FROM tokens WHERE family = $1 AND scope = $2`, family, ScopeAuthentication)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := generateToken(userID, ttl, ScopeRefresh)
+	if err != nil {
+		return nil, err
+	}
+	token.Family = family
+	token.Client = client
+
+	query = `INSERT INTO tokens (hash, user_id, expiry, scope, family, user_agent, ip) VALUES ($1, $2, $3, $4, $5, $6, $7)`
+
+	_, err = tx.ExecContext(ctx, query, token.Hash, token.UserID, token.Expiry, token.Scope, token.Family, token.Client.UserAgent, token.Client.IP)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// Lists the user's unexpired tokens without their hashes
+func (m *DBModel) GetTokenMetadataForUser(userID int64) ([]*TokenMetadata, error) {
+	query := `SELECT id, scope, created_at, last_used_at, expiry, user_agent, ip, used FROM tokens WHERE user_id = $1 AND expiry > $2 ORDER BY expiry`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []*TokenMetadata{}
+
+	for rows.Next() {
+		var token TokenMetadata
+
+		err := rows.Scan(&token.ID, &token.Scope, &token.CreatedAt, &token.LastUsedAt, &token.Expiry, &token.UserAgent, &token.IP, &token.Used)
+		if err != nil {
+			return nil, err
+		}
+
+		tokens = append(tokens, &token)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+// Lists the user's live authentication tokens, flagging the one whose plaintext is passed in
+func (m *DBModel) GetSessionsForUser(userID int64, currentPlaintext string) ([]*TokenMetadata, error) {
+	currentHash := sha256.Sum256([]byte(currentPlaintext))
+
+	query := `
+		SELECT id, scope, created_at, last_used_at, expiry, user_agent, ip, used, hash = $4
+		FROM tokens
+		WHERE user_id = $1 AND scope = $2 AND expiry > $3
+		ORDER BY COALESCE(last_used_at, created_at) DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, ScopeAuthentication, time.Now(), currentHash[:])
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*TokenMetadata{}
+
+	for rows.Next() {
+		var session TokenMetadata
+
+		err := rows.Scan(
+			&session.ID,
+			&session.Scope,
+			&session.CreatedAt,
+			&session.LastUsedAt,
+			&session.Expiry,
+			&session.UserAgent,
+			&session.IP,
+			&session.Used,
+			&session.Current,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		sessions = append(sessions, &session)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// Revokes one of the user's sessions by token ID, along with its refresh token
+func (m *DBModel) DeleteSessionForUser(id, userID int64) error {
+	query := `
+		DELETE FROM tokens
+		WHERE user_id = $2
+		AND ((id = $1 AND scope = $3) OR family = (SELECT family FROM tokens WHERE id = $1 AND user_id = $2 AND scope = $3))`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	results, err := m.DB.ExecContext(ctx, query, id, userID, ScopeAuthentication)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := results.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// Writes a batch of last used times, keyed by token hash
+func (m *DBModel) TouchTokens(lastUsed map[[sha256.Size]byte]time.Time) error {
+	hashes := make([][]byte, 0, len(lastUsed))
+	times := make([]string, 0, len(lastUsed))
+
+	for hash, t := range lastUsed {
+		hash := hash
+		hashes = append(hashes, hash[:])
+		times = append(times, t.Format(time.RFC3339Nano))
+	}
+
+	query := `
+		UPDATE tokens SET last_used_at = touched.at
+		FROM unnest($1::bytea[], $2::timestamptz[]) AS touched(hash, at)
+		WHERE tokens.hash = touched.hash`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, pq.Array(hashes), pq.Array(times))
+	return err
+}
+
+// Random identifier shared by every token issued from one login
+func NewTokenFamily() ([]byte, error) {
+	family := make([]byte, 16)
+
+	_, err := rand.Read(family)
+	if err != nil {
+		return nil, err
+	}
+
+	return family, nil
+}
+
 func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
 	token := &Token{
 		UserID: userID,
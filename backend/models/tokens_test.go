@@ -0,0 +1,93 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+// Tests that need the real schema run against TEST_DB_DSN, a migrated
+// database, and are skipped without it
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	dsn := os.Getenv("TEST_DB_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DB_DSN not set")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+func TestRefreshKeepsOneSessionPerLogin(t *testing.T) {
+	m := &DBModel{DB: openTestDB(t)}
+
+	user := &User{Name: "refresher", Email: fmt.Sprintf("refresher-%d@example.com", time.Now().UnixNano()), Activated: true}
+	if err := user.Password.Set("correct horse battery staple"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Insert(user); err != nil {
+		t.Fatal(err)
+	}
+
+	family, err := NewTokenFamily()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := Client{UserAgent: "test", IP: "192.0.2.1"}
+
+	token, err := m.NewTokenInFamily(user.ID, time.Hour, ScopeAuthentication, family, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refresh, err := m.NewTokenInFamily(user.ID, time.Hour, ScopeRefresh, family, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Refresh twice the way refreshAuthenticationTokenHandler does
+	for i := 0; i < 2; i++ {
+		refresh, err = m.RotateRefreshToken(refresh.Plaintext, time.Hour, client)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		token, err = m.NewTokenInFamily(user.ID, time.Hour, ScopeAuthentication, refresh.Family, client)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sessions, err := m.GetSessionsForUser(user.ID, token.Plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sessions) != 1 || !sessions[0].Current {
+		t.Fatalf("got %d sessions, want the current one only", len(sessions))
+	}
+
+	// Revoking that one session leaves nothing usable behind
+	if err := m.DeleteSessionForUser(sessions[0].ID, user.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.GetForToken(ScopeAuthentication, token.Plaintext); err != ErrRecordNotFound {
+		t.Errorf("GetForToken after revoke err = %v, want ErrRecordNotFound", err)
+	}
+	if _, err := m.RotateRefreshToken(refresh.Plaintext, time.Hour, client); err != ErrRecordNotFound {
+		t.Errorf("RotateRefreshToken after revoke err = %v, want ErrRecordNotFound", err)
+	}
+}
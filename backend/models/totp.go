@@ -0,0 +1,185 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+)
+
+// TOTP holds a user's authenticator secret. It only counts once enabled,
+// which happens after the user proves their app produces valid codes
+type TOTP struct {
+	UserID       int64
+	Secret       string
+	Enabled      bool
+	LastUsedStep int64
+}
+
+func (m *DBModel) GetTOTP(userID int64) (*TOTP, error) {
+	query := `SELECT user_id, secret, enabled, last_used_step FROM users_totp WHERE user_id = $1`
+
+	var t TOTP
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&t.UserID, &t.Secret, &t.Enabled, &t.LastUsedStep)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &t, nil
+}
+
+// Stores a new, not yet enabled, secret replacing any unconfirmed one
+func (m *DBModel) SetTOTPSecret(userID int64, secret string) error {
+	query := `
+		INSERT INTO users_totp (user_id, secret) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET secret = $2, enabled = false, last_used_step = 0, created_at = NOW()`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, secret)
+	return err
+}
+
+func (m *DBModel) EnableTOTP(userID int64) error {
+	query := `UPDATE users_totp SET enabled = true WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID)
+	return err
+}
+
+// Records the time step of an accepted code. It fails with ErrEditConflict if
+// that step, or a later one, was already used so a code only works once
+func (m *DBModel) UseTOTPStep(userID, step int64) error {
+	query := `UPDATE users_totp SET last_used_step = $2 WHERE user_id = $1 AND last_used_step < $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	results, err := m.DB.ExecContext(ctx, query, userID, step)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := results.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrEditConflict
+	}
+
+	return nil
+}
+
+// Turns 2FA off and throws away the secret and recovery codes
+func (m *DBModel) DeleteTOTP(userID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM totp_recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM users_totp WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// NewRecoveryCodes replaces the user's recovery codes with n fresh ones. Only
+// the hashes are stored so the plaintext returned here is the only copy
+func (m *DBModel) NewRecoveryCodes(userID int64, n int) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM totp_recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, n)
+
+	for i := 0; i < n; i++ {
+		randomBytes := make([]byte, 10)
+
+		_, err := rand.Read(randomBytes)
+		if err != nil {
+			return nil, err
+		}
+
+		code := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes))
+		hash := sha256.Sum256([]byte(code))
+
+		_, err = tx.ExecContext(ctx, `INSERT INTO totp_recovery_codes (user_id, hash) VALUES ($1, $2)`, userID, hash[:])
+		if err != nil {
+			return nil, err
+		}
+
+		codes = append(codes, code)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// Consumes a recovery code, returning ErrRecordNotFound if it is not valid
+func (m *DBModel) UseRecoveryCode(userID int64, code string) error {
+	hash := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(code))))
+
+	query := `DELETE FROM totp_recovery_codes WHERE user_id = $1 AND hash = $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	results, err := m.DB.ExecContext(ctx, query, userID, hash[:])
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := results.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
@@ -1,2 +1,153 @@
 package models
 
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+func (m *DBModel) GetUser(id int64) (*User, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `SELECT id, created_at, name, email, password_hash, activated, deletion_requested_at, suspended_at, suspended_until, suspension_reason, version, token_version FROM users WHERE id = $1`
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.DeletionRequestedAt,
+		&user.SuspendedAt,
+		&user.SuspendedUntil,
+		&user.SuspensionReason,
+		&user.Version,
+		&user.TokenVersion,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
+// Hard deletes accounts whose deletion was requested before the cutoff. Their
+// tokens, permissions and dataload rows go with them through ON DELETE CASCADE
+func (m *DBModel) PurgeUsersPendingDeletion(cutoff time.Time) (int64, error) {
+	query := `DELETE FROM users WHERE deletion_requested_at < $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	results, err := m.DB.ExecContext(ctx, query, cutoff)
+	if err != nil {
+		return 0, err
+	}
+
+	return results.RowsAffected()
+}
+
+// Lists users for the admin API. Empty name or email and a nil activated skip that filter
+func (m *DBModel) GetAllUsers(name, email string, activated *bool, filters Filters) ([]*User, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, created_at, name, email, password_hash, activated, deletion_requested_at, suspended_at, suspended_until, suspension_reason, version, token_version
+		FROM users
+		WHERE (to_tsvector('simple', name) @@ plainto_tsquery('simple', $1) OR $1 = '')
+		AND (email ILIKE '%%' || $2 || '%%' ESCAPE '\' OR $2 = '')
+		AND (activated = $3 OR $3::bool IS NULL)
+		ORDER BY %s %s, id ASC
+		LIMIT $4 OFFSET $5`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []interface{}{name, escapeLike(email), activated, filters.limit(), filters.offset()}
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	users := []*User{}
+
+	for rows.Next() {
+		var user User
+
+		err := rows.Scan(
+			&totalRecords,
+			&user.ID,
+			&user.CreatedAt,
+			&user.Name,
+			&user.Email,
+			&user.Password.hash,
+			&user.Activated,
+			&user.DeletionRequestedAt,
+			&user.SuspendedAt,
+			&user.SuspendedUntil,
+			&user.SuspensionReason,
+			&user.Version,
+			&user.TokenVersion,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		users = append(users, &user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := createMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return users, metadata, nil
+}
+
+// Rehashes a password that just matched with the current hasher. The old hash
+// is part of the WHERE so a password changed in the meantime is left alone
+func (m *DBModel) RehashPassword(user *User, plaintextPassword string) error {
+	oldHash := user.Password.hash
+
+	err := user.Password.Set(plaintextPassword)
+	if err != nil {
+		return err
+	}
+
+	query := `UPDATE users SET password_hash = $1 WHERE id = $2 AND password_hash = $3`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, query, user.Password.hash, user.ID, oldHash)
+	return err
+}
+
+// Stateless JWTs carry the token version they were issued with, so bumping
+// it signs the user out of every JWT at once
+func (m *DBModel) RevokeJWTs(userID int64) error {
+	query := `UPDATE users SET token_version = token_version + 1 WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID)
+	return err
+}
@@ -0,0 +1,87 @@
+package oauth
+
+import (
+	"context"
+	"strconv"
+	"strings"
+)
+
+// GitHub does not speak OpenID Connect, so it gets its own provider. The base
+// URL is github.com or the address of a GitHub Enterprise server
+type GitHub struct {
+	baseURL string
+	apiURL  string
+	cfg     Config
+}
+
+func NewGitHub(baseURL string, cfg Config) *GitHub {
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"read:user", "user:email"}
+	}
+
+	baseURL = strings.TrimSuffix(baseURL, "/")
+
+	apiURL := baseURL + "/api/v3"
+	if baseURL == "https://github.com" {
+		apiURL = "https://api.github.com"
+	}
+
+	return &GitHub{baseURL: baseURL, apiURL: apiURL, cfg: cfg}
+}
+
+func (p *GitHub) AuthCodeURL(ctx context.Context, state, verifier string) (string, error) {
+	return authCodeURL(p.baseURL+"/login/oauth/authorize", p.cfg, state, verifier, nil), nil
+}
+
+func (p *GitHub) Exchange(ctx context.Context, code, verifier string) (*Identity, error) {
+	tokens, err := exchangeCode(ctx, p.baseURL+"/login/oauth/access_token", p.cfg, code, verifier)
+	if err != nil {
+		return nil, err
+	}
+	accessToken := tokens.AccessToken
+
+	var user struct {
+		ID    int64  `json:"id"`
+		Login string `json:"login"`
+		Name  string `json:"name"`
+	}
+
+	err = getJSON(ctx, p.apiURL+"/user", accessToken, &user)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.ID == 0 {
+		return nil, ErrExchange
+	}
+
+	// Only the emails endpoint says whether the primary address is verified
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+
+	err = getJSON(ctx, p.apiURL+"/user/emails", accessToken, &emails)
+	if err != nil {
+		return nil, err
+	}
+
+	identity := &Identity{
+		Subject: strconv.FormatInt(user.ID, 10),
+		Name:    user.Name,
+	}
+
+	if identity.Name == "" {
+		identity.Name = user.Login
+	}
+
+	for _, email := range emails {
+		if email.Primary {
+			identity.Email = email.Email
+			identity.EmailVerified = email.Verified
+		}
+	}
+
+	return identity, nil
+}
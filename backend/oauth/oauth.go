@@ -0,0 +1,175 @@
+package oauth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ErrExchange covers every way a provider can refuse the code we got back
+var ErrExchange = errors.New("oauth code exchange failed")
+
+// Identity is what a provider tells us about the person who signed in
+type Identity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// Provider is one external sign in service using the authorization code flow with PKCE
+type Provider interface {
+	// AuthCodeURL is where the browser goes to sign in
+	AuthCodeURL(ctx context.Context, state, verifier string) (string, error)
+
+	// Exchange trades the code from the redirect for the signed in identity
+	Exchange(ctx context.Context, code, verifier string) (*Identity, error)
+}
+
+// Config holds the client registration shared by all providers
+type Config struct {
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+}
+
+var client = &http.Client{Timeout: 10 * time.Second}
+
+var encoding = base64.RawURLEncoding
+
+// NewVerifier returns a random PKCE code verifier (RFC 7636)
+func NewVerifier() (string, error) {
+	b := make([]byte, 32)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return encoding.EncodeToString(b), nil
+}
+
+func challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return encoding.EncodeToString(sum[:])
+}
+
+// The OIDC nonce is derived from the PKCE verifier, so it is bound to the same
+// browser without another value to keep in the state cookie
+func nonce(verifier string) string {
+	sum := sha256.Sum256([]byte("nonce:" + verifier))
+	return encoding.EncodeToString(sum[:])
+}
+
+func authCodeURL(endpoint string, cfg Config, state, verifier string, extra url.Values) string {
+	params := url.Values{}
+	for key, values := range extra {
+		params[key] = values
+	}
+	params.Set("response_type", "code")
+	params.Set("client_id", cfg.ClientID)
+	params.Set("redirect_uri", cfg.RedirectURL)
+	params.Set("scope", strings.Join(cfg.Scopes, " "))
+	params.Set("state", state)
+	params.Set("code_challenge", challenge(verifier))
+	params.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(endpoint, "?") {
+		sep = "&"
+	}
+
+	return endpoint + sep + params.Encode()
+}
+
+// What the token endpoint answers with. OpenID providers add the ID token
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	IDToken     string `json:"id_token"`
+}
+
+// Swaps the authorization code for an access token at the token endpoint
+func exchangeCode(ctx context.Context, endpoint string, cfg Config, code, verifier string) (*tokenResponse, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", cfg.RedirectURL)
+	form.Set("client_id", cfg.ClientID)
+	form.Set("client_secret", cfg.ClientSecret)
+	form.Set("code_verifier", verifier)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	var output struct {
+		tokenResponse
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+
+	err = do(req, &output)
+	if err != nil {
+		return nil, err
+	}
+
+	// GitHub reports errors with a 200 status, so check the body as well
+	if output.Error != "" || output.AccessToken == "" {
+		return nil, fmt.Errorf("%w: %s %s", ErrExchange, output.Error, output.ErrorDescription)
+	}
+
+	return &output.tokenResponse, nil
+}
+
+// Fetches a JSON document using the access token
+func getJSON(ctx context.Context, endpoint, accessToken string, dst interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Accept", "application/json")
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+
+	return do(req, dst)
+}
+
+func do(req *http.Request, dst interface{}) error {
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("%w: %s returned %s: %.200s", ErrExchange, req.URL.Host, res.Status, body)
+	}
+
+	err = json.Unmarshal(body, dst)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrExchange, err)
+	}
+
+	return nil
+}
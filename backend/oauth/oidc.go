@@ -0,0 +1,191 @@
+package oauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pascaldekloe/jwt"
+)
+
+// OIDC is any OpenID Connect provider, found through its issuer's discovery
+// document. Google is one, and so is a local mock server in development
+type OIDC struct {
+	issuer string
+	cfg    Config
+
+	mu        sync.Mutex
+	endpoints *oidcEndpoints
+	keys      *jwt.KeyRegister
+}
+
+type oidcEndpoints struct {
+	Issuer        string `json:"issuer"`
+	Authorization string `json:"authorization_endpoint"`
+	Token         string `json:"token_endpoint"`
+	UserInfo      string `json:"userinfo_endpoint"`
+	JWKS          string `json:"jwks_uri"`
+}
+
+func NewOIDC(issuer string, cfg Config) *OIDC {
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "email", "profile"}
+	}
+
+	return &OIDC{issuer: strings.TrimSuffix(issuer, "/"), cfg: cfg}
+}
+
+// Discovery runs on first use and is retried until it works once, so an
+// unreachable provider does not stop the server from starting
+func (p *OIDC) discover(ctx context.Context) (*oidcEndpoints, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.endpoints != nil {
+		return p.endpoints, nil
+	}
+
+	var endpoints oidcEndpoints
+
+	err := getJSON(ctx, p.issuer+"/.well-known/openid-configuration", "", &endpoints)
+	if err != nil {
+		return nil, err
+	}
+
+	// The document must name the issuer we asked, or its keys prove nothing
+	if strings.TrimSuffix(endpoints.Issuer, "/") != p.issuer || endpoints.JWKS == "" {
+		return nil, fmt.Errorf("%w: bad discovery document for %s", ErrExchange, p.issuer)
+	}
+
+	p.endpoints = &endpoints
+	return p.endpoints, nil
+}
+
+// Signing keys are cached and fetched again when a token names a key we have
+// not seen, which is how providers roll them over
+func (p *OIDC) signingKeys(ctx context.Context, jwksURI string, refresh bool) (*jwt.KeyRegister, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.keys != nil && !refresh {
+		return p.keys, nil
+	}
+
+	var jwks json.RawMessage
+
+	err := getJSON(ctx, jwksURI, "", &jwks)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys jwt.KeyRegister
+
+	_, err = keys.LoadJWK(jwks)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrExchange, err)
+	}
+
+	p.keys = &keys
+	return p.keys, nil
+}
+
+func (p *OIDC) AuthCodeURL(ctx context.Context, state, verifier string) (string, error) {
+	endpoints, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	extra := url.Values{"nonce": {nonce(verifier)}}
+
+	return authCodeURL(endpoints.Authorization, p.cfg, state, verifier, extra), nil
+}
+
+// Checks the ID token's signature, issuer, audience, expiry and nonce, and
+// returns the subject it was issued for
+func (p *OIDC) verifyIDToken(ctx context.Context, endpoints *oidcEndpoints, idToken, verifier string) (string, error) {
+	keys, err := p.signingKeys(ctx, endpoints.JWKS, false)
+	if err != nil {
+		return "", err
+	}
+
+	claims, err := keys.Check([]byte(idToken))
+	if errors.Is(err, jwt.ErrSigMiss) {
+		keys, err = p.signingKeys(ctx, endpoints.JWKS, true)
+		if err != nil {
+			return "", err
+		}
+
+		claims, err = keys.Check([]byte(idToken))
+	}
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrExchange, err)
+	}
+
+	nonceClaim, _ := claims.String("nonce")
+
+	switch {
+	case !claims.Valid(time.Now()):
+		return "", fmt.Errorf("%w: ID token expired", ErrExchange)
+	case strings.TrimSuffix(claims.Issuer, "/") != p.issuer:
+		return "", fmt.Errorf("%w: ID token issuer %q", ErrExchange, claims.Issuer)
+	case !claims.AcceptAudience(p.cfg.ClientID):
+		return "", fmt.Errorf("%w: ID token is for another client", ErrExchange)
+	case nonceClaim != nonce(verifier):
+		return "", fmt.Errorf("%w: ID token nonce mismatch", ErrExchange)
+	case claims.Subject == "":
+		return "", fmt.Errorf("%w: ID token has no subject", ErrExchange)
+	}
+
+	return claims.Subject, nil
+}
+
+func (p *OIDC) Exchange(ctx context.Context, code, verifier string) (*Identity, error) {
+	endpoints, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens, err := exchangeCode(ctx, endpoints.Token, p.cfg, code, verifier)
+	if err != nil {
+		return nil, err
+	}
+
+	if tokens.IDToken == "" {
+		return nil, fmt.Errorf("%w: no ID token", ErrExchange)
+	}
+
+	subject, err := p.verifyIDToken(ctx, endpoints, tokens.IDToken, verifier)
+	if err != nil {
+		return nil, err
+	}
+
+	// The profile comes from userinfo, which must describe the same subject
+	// the ID token was issued for
+	var info struct {
+		Subject       string `json:"sub"`
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+		Name          string `json:"name"`
+	}
+
+	err = getJSON(ctx, endpoints.UserInfo, tokens.AccessToken, &info)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.Subject != subject {
+		return nil, fmt.Errorf("%w: userinfo subject does not match the ID token", ErrExchange)
+	}
+
+	return &Identity{
+		Subject:       info.Subject,
+		Email:         info.Email,
+		EmailVerified: info.EmailVerified,
+		Name:          info.Name,
+	}, nil
+}
@@ -0,0 +1,240 @@
+package oauth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/pascaldekloe/jwt"
+)
+
+// mockOIDC is a tiny OpenID provider that hands out one code for a PKCE
+// challenge and checks the verifier when the code is exchanged
+type mockOIDC struct {
+	*httptest.Server
+
+	code      string
+	challenge string
+	userinfo  map[string]interface{}
+
+	// What goes into the ID token, tests change these to break it
+	key     *rsa.PrivateKey
+	idToken jwt.Claims
+}
+
+func newMockOIDC(t *testing.T) *mockOIDC {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &mockOIDC{
+		code: "the-code",
+		key:  key,
+		userinfo: map[string]interface{}{
+			"sub":            "248289761001",
+			"email":          "jane@example.com",
+			"email_verified": true,
+			"name":           "Jane Doe",
+		},
+	}
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 m.URL,
+			"authorization_endpoint": m.URL + "/authorize",
+			"token_endpoint":         m.URL + "/token",
+			"userinfo_endpoint":      m.URL + "/userinfo",
+			"jwks_uri":               m.URL + "/jwks",
+		})
+	})
+
+	// Only the key the provider was started with is published
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "mock-key",
+				"n":   encoding.EncodeToString(key.N.Bytes()),
+				"e":   encoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+
+		switch {
+		case r.Form.Get("client_id") != "client" || r.Form.Get("client_secret") != "secret":
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+		case r.Form.Get("code") != m.code || challenge(r.Form.Get("code_verifier")) != m.challenge:
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		default:
+			claims := m.idToken
+			claims.KeyID = "mock-key"
+
+			idToken, err := claims.RSASign(jwt.RS256, m.key)
+			if err != nil {
+				t.Error(err)
+			}
+
+			json.NewEncoder(w).Encode(map[string]string{"access_token": "the-access-token", "token_type": "Bearer", "id_token": string(idToken)})
+		}
+	})
+
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer the-access-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(m.userinfo)
+	})
+
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+
+	m.idToken = jwt.Claims{Registered: jwt.Registered{
+		Issuer:    m.URL,
+		Subject:   "248289761001",
+		Audiences: []string{"client"},
+		Expires:   jwt.NewNumericTime(time.Now().Add(time.Hour)),
+	}}
+
+	return m
+}
+
+// Sets the nonce the next ID token carries, as the provider would from the
+// authorization request
+func (m *mockOIDC) expectVerifier(verifier string) {
+	m.challenge = challenge(verifier)
+	m.idToken.Set = map[string]interface{}{"nonce": nonce(verifier)}
+}
+
+func TestOIDCSignIn(t *testing.T) {
+	m := newMockOIDC(t)
+
+	p := NewOIDC(m.URL+"/", Config{ClientID: "client", ClientSecret: "secret", RedirectURL: "http://localhost:3000/oauth/mock"})
+
+	verifier, err := NewVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authURL, err := p.AuthCodeURL(context.Background(), "the-state", verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := u.Query()
+
+	if got := u.Scheme + "://" + u.Host + u.Path; got != m.URL+"/authorize" {
+		t.Errorf("authorization endpoint = %q", got)
+	}
+
+	for key, want := range map[string]string{
+		"response_type":         "code",
+		"client_id":             "client",
+		"redirect_uri":          "http://localhost:3000/oauth/mock",
+		"scope":                 "openid email profile",
+		"state":                 "the-state",
+		"code_challenge":        challenge(verifier),
+		"code_challenge_method": "S256",
+		"nonce":                 nonce(verifier),
+	} {
+		if got := q.Get(key); got != want {
+			t.Errorf("%s = %q, want %q", key, got, want)
+		}
+	}
+
+	// The provider only knows the challenge and nonce, like a real one would
+	m.challenge = q.Get("code_challenge")
+	m.idToken.Set = map[string]interface{}{"nonce": q.Get("nonce")}
+
+	identity, err := p.Exchange(context.Background(), m.code, verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := Identity{Subject: "248289761001", Email: "jane@example.com", EmailVerified: true, Name: "Jane Doe"}
+	if *identity != want {
+		t.Errorf("identity = %+v, want %+v", *identity, want)
+	}
+}
+
+func TestOIDCExchangeFailures(t *testing.T) {
+	verifier, err := NewVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := NewVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		breakIt func(m *mockOIDC, cfg *Config, code, verifier *string)
+	}{
+		{"wrong verifier", func(m *mockOIDC, cfg *Config, code, v *string) { *v = other }},
+		{"wrong code", func(m *mockOIDC, cfg *Config, code, v *string) { *code = "another-code" }},
+		{"wrong client secret", func(m *mockOIDC, cfg *Config, code, v *string) { cfg.ClientSecret = "wrong" }},
+		{"missing subject", func(m *mockOIDC, cfg *Config, code, v *string) { delete(m.userinfo, "sub") }},
+		{"userinfo for another subject", func(m *mockOIDC, cfg *Config, code, v *string) { m.userinfo["sub"] = "someone-else" }},
+		{"ID token signed by another key", func(m *mockOIDC, cfg *Config, code, v *string) { m.key = otherKey }},
+		{"ID token from another issuer", func(m *mockOIDC, cfg *Config, code, v *string) { m.idToken.Issuer = "https://evil.example.com" }},
+		{"ID token for another client", func(m *mockOIDC, cfg *Config, code, v *string) { m.idToken.Audiences = []string{"another-client"} }},
+		{"ID token expired", func(m *mockOIDC, cfg *Config, code, v *string) {
+			m.idToken.Expires = jwt.NewNumericTime(time.Now().Add(-time.Minute))
+		}},
+		{"ID token for another sign in", func(m *mockOIDC, cfg *Config, code, v *string) { m.idToken.Set["nonce"] = nonce(other) }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMockOIDC(t)
+			m.expectVerifier(verifier)
+
+			cfg := Config{ClientID: "client", ClientSecret: "secret"}
+			code, v := m.code, verifier
+
+			tt.breakIt(m, &cfg, &code, &v)
+
+			_, err := NewOIDC(m.URL, cfg).Exchange(context.Background(), code, v)
+			if !errors.Is(err, ErrExchange) {
+				t.Errorf("Exchange error = %v, want ErrExchange", err)
+			}
+		})
+	}
+
+	// Nothing above fails for a reason other than the one it breaks
+	m := newMockOIDC(t)
+	m.expectVerifier(verifier)
+
+	_, err = NewOIDC(m.URL, Config{ClientID: "client", ClientSecret: "secret"}).Exchange(context.Background(), m.code, verifier)
+	if err != nil {
+		t.Fatalf("unbroken exchange: %v", err)
+	}
+}
@@ -0,0 +1,61 @@
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+// RFC 6238 appendix B, SHA1 rows. The RFC lists 8 digit codes, the last six
+// digits of each are what a 6 digit authenticator shows
+func TestCodeAtRFC6238(t *testing.T) {
+	key := []byte("12345678901234567890")
+
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+
+	for _, tt := range tests {
+		want := tt.want[len(tt.want)-Digits:]
+
+		got := codeAt(key, tt.unix/int64(Period.Seconds()))
+		if got != want {
+			t.Errorf("codeAt at %d = %q, want %q", tt.unix, got, want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret := encoding.EncodeToString([]byte("12345678901234567890"))
+	now := time.Unix(1111111109, 0)
+
+	tests := []struct {
+		name string
+		code string
+		at   time.Time
+		want bool
+	}{
+		{"current step", "081804", now, true},
+		{"previous step", "081804", now.Add(Period), true},
+		{"next step", "081804", now.Add(-Period), true},
+		{"outside drift", "081804", now.Add(2 * Period), false},
+		{"wrong code", "123456", now, false},
+		{"wrong length", "81804", now, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, ok := Validate(secret, tt.code, tt.at)
+			if ok != tt.want {
+				t.Errorf("Validate(%q) = %v, want %v", tt.code, ok, tt.want)
+			}
+		})
+	}
+}
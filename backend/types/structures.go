@@ -1,9 +1,15 @@
 package types
 
+import "time"
+
 type Config struct {
 	Port int
 	Env  string
-	Db   struct {
+
+	// Granted users:admin on startup, so a fresh install has someone who
+	// can reach the admin routes
+	AdminEmail string
+	Db         struct {
 		Dsn string
 	}
 	Jwt struct {
@@ -14,6 +20,39 @@ type Config struct {
 		Burst   int
 		Enabled bool
 	}
+	Cookie struct {
+		Domain string
+	}
+	Cors struct {
+		TrustedOrigins []string
+	}
+	Password struct {
+		MinLength    int
+		MinClasses   int
+		MinEntropy   float64
+		BreachedFile string
+		Hasher       string
+		BcryptCost   int
+		Argon2       struct {
+			Memory      uint
+			Iterations  uint
+			Parallelism uint
+		}
+	}
+	Lockout struct {
+		Threshold   int
+		IPThreshold int
+		Duration    time.Duration
+		Backoff     time.Duration
+	}
+	Deletion struct {
+		GraceDays int
+	}
+	OAuth struct {
+		RedirectURL string
+		Google      OAuthProvider
+		GitHub      OAuthProvider
+	}
 	SMTP struct {
 		Host     string
 		Port     int
@@ -22,3 +61,11 @@ type Config struct {
 		Sender   string
 	}
 }
+
+// An external sign in provider, left disabled while ClientID is empty
+type OAuthProvider struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	AutoLink     bool
+}
@@ -0,0 +1,328 @@
+package validator
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	_ "embed"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+//go:embed common_passwords.txt
+var commonPasswordsFile string
+
+// Ranked most common first, a lower rank makes a word cheaper to guess
+var commonPasswords = func() map[string]int {
+	ranks := make(map[string]int)
+	for i, word := range strings.Fields(commonPasswordsFile) {
+		if _, exists := ranks[word]; !exists {
+			ranks[word] = i + 1
+		}
+	}
+	return ranks
+}()
+
+// Keyboard rows an attacker walks along, e.g. "asdf" or "7890"
+var keyboardRows = []string{"1234567890", "qwertyuiop", "asdfghjkl", "zxcvbnm"}
+
+// PasswordPolicy is what a new password has to live up to. Zero values
+// switch a rule off
+type PasswordPolicy struct {
+	MinLength int
+
+	// How many of lowercase, uppercase, digits and symbols must appear
+	MinClasses int
+
+	// Estimated guessing entropy in bits, see PasswordEntropy
+	MinEntropy float64
+
+	Breached *BreachedPasswords
+}
+
+// Check adds at most one error under key, for the first rule the password
+// breaks. personal holds things like the user's email and name
+func (p *PasswordPolicy) Check(v *Validator, key, password string, personal ...string) {
+	v.Check(len(password) >= p.MinLength, key, fmt.Sprintf("must be at least %d characters long", p.MinLength))
+	v.Check(passwordClasses(password) >= p.MinClasses, key, fmt.Sprintf("must use at least %d of lowercase letters, uppercase letters, digits and symbols", p.MinClasses))
+
+	lower := strings.ToLower(password)
+	for _, word := range personalWords(personal) {
+		v.Check(!strings.Contains(lower, word), key, "must not contain your name or email address")
+	}
+
+	if p.Breached != nil {
+		v.Check(!p.Breached.Contains(password), key, "has appeared in a data breach, please choose another")
+	}
+
+	v.Check(PasswordEntropy(password, personal...) >= p.MinEntropy, key, "is too easy to guess, try a longer password or a few unrelated words")
+}
+
+func passwordClasses(password string) int {
+	var lower, upper, digit, symbol int
+
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+
+	return lower + upper + digit + symbol
+}
+
+// Splits emails and names into the lowercase words worth looking for
+func personalWords(personal []string) []string {
+	var words []string
+
+	for _, value := range personal {
+		value = strings.ToLower(value)
+		if at := strings.Index(value, "@"); at >= 0 {
+			value = value[:at]
+		}
+
+		for _, word := range strings.FieldsFunc(value, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }) {
+			if len(word) >= 3 {
+				words = append(words, word)
+			}
+		}
+	}
+
+	return words
+}
+
+// PasswordEntropy estimates how many bits of guessing a password takes, in
+// the spirit of zxcvbn. The password is split greedily into the cheapest
+// patterns we know (common words, personal words, repeats, sequences and
+// keyboard walks) and whatever is left is charged per character
+func PasswordEntropy(password string, personal ...string) float64 {
+	// Personal words are the first thing a targeted guess tries
+	dictionary := commonPasswords
+	if words := personalWords(personal); len(words) > 0 {
+		dictionary = make(map[string]int, len(commonPasswords)+len(words))
+		for word, rank := range commonPasswords {
+			dictionary[word] = rank
+		}
+		for _, word := range words {
+			dictionary[word] = 1
+		}
+	}
+
+	runes := []rune(password)
+	lower := []rune(strings.ToLower(password))
+
+	bits := 0.0
+
+	for i := 0; i < len(runes); {
+		length, cost := 1, charBits(runes[i])
+
+		for j := len(runes); j >= i+3; j-- {
+			if c, ok := patternBits(runes[i:j], lower[i:j], dictionary); ok && c < cost*float64(j-i) {
+				length, cost = j-i, c
+				break
+			}
+		}
+
+		bits += cost
+		i += length
+	}
+
+	return bits
+}
+
+// The cost of guessing one character picked from its class
+func charBits(r rune) float64 {
+	switch {
+	case unicode.IsLower(r), unicode.IsUpper(r):
+		return math.Log2(26)
+	case unicode.IsDigit(r):
+		return math.Log2(10)
+	default:
+		return math.Log2(33)
+	}
+}
+
+// Returns the cost of the whole segment if it is one known pattern
+func patternBits(segment, lower []rune, dictionary map[string]int) (float64, bool) {
+	n := len(segment)
+	word := string(lower)
+
+	// Capitalising a word or using leetspeak barely slows anyone down
+	if rank, ok := dictionary[unleet(word)]; ok {
+		bits := math.Log2(float64(rank) + 1)
+		if string(segment) != word {
+			bits++
+		}
+		if unleet(word) != word {
+			bits++
+		}
+		return bits, true
+	}
+
+	if strings.Count(word, string(lower[0])) == n {
+		return charBits(segment[0]) + math.Log2(float64(n)), true
+	}
+
+	step := lower[1] - lower[0]
+	if step == 1 || step == -1 {
+		sequence := true
+		for k := 2; k < n; k++ {
+			if lower[k]-lower[k-1] != step {
+				sequence = false
+				break
+			}
+		}
+		if sequence {
+			return charBits(segment[0]) + math.Log2(float64(n)) + 1, true
+		}
+	}
+
+	if n >= 4 {
+		for _, row := range keyboardRows {
+			if strings.Contains(row, word) || strings.Contains(reverse(row), word) {
+				return math.Log2(float64(len(keyboardRows)*len(row))) + math.Log2(float64(n)), true
+			}
+		}
+	}
+
+	return 0, false
+}
+
+func unleet(word string) string {
+	return strings.NewReplacer("0", "o", "1", "i", "3", "e", "4", "a", "5", "s", "7", "t", "@", "a", "$", "s").Replace(word)
+}
+
+func reverse(s string) string {
+	runes := []rune(s)
+	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+		runes[i], runes[j] = runes[j], runes[i]
+	}
+	return string(runes)
+}
+
+// BreachedPasswords holds SHA-1 hashes of leaked passwords. It loads either
+// one file of full 40 character hex hashes, or a directory laid out the way
+// the Pwned Passwords k-anonymity range API serves it: one file per 5
+// character prefix, e.g. 21BD1.txt, holding the 35 character suffixes. Either
+// way each line may be followed by ":count"
+type BreachedPasswords struct {
+	hashes [][sha1.Size]byte
+}
+
+// Length of the hash prefix the range API splits its files by
+const breachedPrefixLength = 5
+
+func LoadBreachedPasswords(path string) (*BreachedPasswords, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	list := &BreachedPasswords{}
+
+	if !info.IsDir() {
+		err = list.loadFile(path, "")
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			prefix := strings.ToUpper(strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name())))
+			if entry.IsDir() || !isHex(prefix, breachedPrefixLength) {
+				continue
+			}
+
+			err = list.loadFile(filepath.Join(path, entry.Name()), prefix)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// The downloads come sorted by hash already, but do not rely on it
+	sort.Slice(list.hashes, func(i, j int) bool {
+		return bytes.Compare(list.hashes[i][:], list.hashes[j][:]) < 0
+	})
+
+	return list, nil
+}
+
+// Reads one file of hashes. With a prefix every line is the rest of a hash
+func (b *BreachedPasswords) loadFile(path, prefix string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		if colon := strings.IndexByte(text, ':'); colon >= 0 {
+			text = text[:colon]
+		}
+
+		text = prefix + text
+
+		// Checked up front, decoding a longer line would overflow the array
+		if !isHex(text, 2*sha1.Size) {
+			return fmt.Errorf("%s line %d: not a SHA-1 hash", path, line)
+		}
+
+		var hash [sha1.Size]byte
+		hex.Decode(hash[:], []byte(text))
+
+		b.hashes = append(b.hashes, hash)
+	}
+
+	return scanner.Err()
+}
+
+func isHex(s string, length int) bool {
+	if len(s) != length {
+		return false
+	}
+
+	for _, r := range s {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", r) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (b *BreachedPasswords) Len() int {
+	return len(b.hashes)
+}
+
+func (b *BreachedPasswords) Contains(password string) bool {
+	hash := sha1.Sum([]byte(password))
+
+	i := sort.Search(len(b.hashes), func(i int) bool {
+		return bytes.Compare(b.hashes[i][:], hash[:]) >= 0
+	})
+
+	return i < len(b.hashes) && b.hashes[i] == hash
+}
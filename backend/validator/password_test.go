@@ -0,0 +1,169 @@
+package validator
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPasswordEntropy(t *testing.T) {
+	tests := []struct {
+		password string
+		personal []string
+		min, max float64
+	}{
+		{"password", nil, 0, 2},
+		{"P@ssw0rd", nil, 0, 4},
+		{"aaaaaaaaaaaa", nil, 0, 10},
+		{"abcdefghijkl", nil, 0, 10},
+		{"qwertyuiop", nil, 0, 10},
+		{"xk7#Qm2!vR9p", nil, 50, 80},
+		{"correct horse battery staple", nil, 100, 200},
+		{"janedoe1990", nil, 40, 60},
+		{"janedoe1990", []string{"jane.doe@example.com", "Jane Doe"}, 0, 20},
+	}
+
+	for _, tt := range tests {
+		got := PasswordEntropy(tt.password, tt.personal...)
+		if got < tt.min || got > tt.max {
+			t.Errorf("PasswordEntropy(%q, %q) = %.1f, want between %.0f and %.0f", tt.password, tt.personal, got, tt.min, tt.max)
+		}
+	}
+}
+
+func TestPasswordPolicyCheck(t *testing.T) {
+	breached := &BreachedPasswords{hashes: [][sha1.Size]byte{sha1.Sum([]byte("Breached#Pa55word"))}}
+
+	policy := &PasswordPolicy{MinLength: 10, MinClasses: 3, MinEntropy: 40, Breached: breached}
+
+	tests := []struct {
+		password string
+		want     string
+	}{
+		{"xk7#Qm2!vR9p", ""},
+		{"Short1!", "at least 10 characters"},
+		{"alllowercaseletters", "at least 3 of"},
+		{"JaneSecret42!", "your name or email"},
+		{"Breached#Pa55word", "data breach"},
+		{"Password1234", "too easy to guess"},
+	}
+
+	for _, tt := range tests {
+		v := New()
+		policy.Check(v, "password", tt.password, "jane.doe@example.com", "Jane Doe")
+
+		got := v.Errors["password"]
+		if tt.want == "" && got != "" || !strings.Contains(got, tt.want) {
+			t.Errorf("Check(%q) error = %q, want %q", tt.password, got, tt.want)
+		}
+	}
+
+	// Zero values switch every rule off
+	v := New()
+	(&PasswordPolicy{}).Check(v, "password", "a")
+	if !v.Valid() {
+		t.Errorf("empty policy errors = %v", v.Errors)
+	}
+}
+
+func sha1Hex(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+func TestLoadBreachedPasswordsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pwned.txt")
+
+	lines := []string{
+		sha1Hex("hunter2") + ":17",
+		"",
+		strings.ToLower(sha1Hex("letmein")),
+		sha1Hex("trustno1") + ":3",
+	}
+
+	err := os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := LoadBreachedPasswords(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if list.Len() != 3 {
+		t.Errorf("Len = %d, want 3", list.Len())
+	}
+
+	for password, want := range map[string]bool{
+		"hunter2":  true,
+		"letmein":  true,
+		"trustno1": true,
+		"hunter3":  false,
+		"":         false,
+	} {
+		if got := list.Contains(password); got != want {
+			t.Errorf("Contains(%q) = %v, want %v", password, got, want)
+		}
+	}
+}
+
+func TestLoadBreachedPasswordsRangeDirectory(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, password := range []string{"hunter2", "letmein"} {
+		hash := sha1Hex(password)
+		name := filepath.Join(dir, hash[:5]+".txt")
+
+		err := os.WriteFile(name, []byte(hash[5:]+":42\n"), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Anything not named after a prefix is ignored
+	err := os.WriteFile(filepath.Join(dir, "README.md"), []byte("not hashes\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := LoadBreachedPasswords(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if list.Len() != 2 || !list.Contains("hunter2") || !list.Contains("letmein") || list.Contains("trustno1") {
+		t.Errorf("loaded %d hashes, hunter2 %v, letmein %v, trustno1 %v", list.Len(), list.Contains("hunter2"), list.Contains("letmein"), list.Contains("trustno1"))
+	}
+}
+
+func TestLoadBreachedPasswordsRejectsBadLines(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+	}{
+		{"too long", sha1Hex("hunter2") + "ABCD"},
+		{"too short", sha1Hex("hunter2")[:39]},
+		{"not hex", strings.Repeat("Z", 40)},
+		{"range suffix in a full hash file", sha1Hex("hunter2")[5:]},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "pwned.txt")
+
+			err := os.WriteFile(path, []byte(tt.line+"\n"), 0o600)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = LoadBreachedPasswords(path)
+			if err == nil || !strings.Contains(err.Error(), "line 1") {
+				t.Errorf("err = %v, want a line 1 error", err)
+			}
+		})
+	}
+}